@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gopher-net/macvlan-docker-plugin/macvlan"
+)
+
+// defaultAdminSocket is kept out of the plugin socket directory so dockerd
+// doesn't discover it as another plugin
+const defaultAdminSocket = "/run/macvlan/admin.sock"
+
+// newAdminListener creates the unix socket operator endpoints are served on
+func newAdminListener(path string) (*listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// a socket left by a plugin that was killed would fail the listen
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create the admin socket [ %s ]: %s", path, err)
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	log.Infof("Admin endpoints listening on unix socket [ %s ]", path)
+	return &listener{Listener: l, cleanup: []string{path}}, nil
+}
+
+// serveAdmin serves /healthz, 200 when every check passes and 503 otherwise
+func serveAdmin(l net.Listener, d *macvlan.Driver) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		report := d.HealthCheck()
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+	return http.Serve(l, mux)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/codegangsta/cli"
+	"github.com/gopher-net/macvlan-docker-plugin/macvlan"
+)
+
+const auditTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// auditCommand prints the host changes recorded in the --audit-log file
+var auditCommand = cli.Command{
+	Name:  "audit",
+	Usage: "show the host network changes recorded in the audit log, filtered by network or endpoint",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "audit-log",
+			Usage:  "audit log written by the plugin --audit-log",
+			EnvVar: "MACVLAN_AUDIT_LOG",
+		},
+		cli.StringFlag{
+			Name:  "network",
+			Usage: "network ID or ID prefix",
+		},
+		cli.StringFlag{
+			Name:  "endpoint",
+			Usage: "endpoint ID or ID prefix",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the matching records as JSON lines",
+		},
+	},
+	Action: func(ctx *cli.Context) {
+		if err := runAudit(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "audit failed: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func runAudit(ctx *cli.Context) error {
+	path := ctx.String("audit-log")
+	if path == "" {
+		return fmt.Errorf("--audit-log is required")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	network, endpoint := ctx.String("network"), ctx.String("endpoint")
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	if !ctx.Bool("json") {
+		fmt.Fprintln(w, "TIME\tCALL\tNETWORK\tENDPOINT\tOP\tTARGET\tDETAIL\tRESULT")
+	}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		rec := &macvlan.AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			// a crash can leave a partial last line
+			fmt.Fprintf(os.Stderr, "skipping invalid record on line %d: %s\n", line, err)
+			continue
+		}
+		if !strings.HasPrefix(rec.NetworkID, network) || !strings.HasPrefix(rec.EndpointID, endpoint) {
+			continue
+		}
+		if ctx.Bool("json") {
+			fmt.Fprintln(w, scanner.Text())
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", rec.Time.Format(auditTimeFormat), rec.Call,
+			shortID(rec.NetworkID), shortID(rec.EndpointID), rec.Op, rec.Target, rec.Detail, rec.Result)
+	}
+	return scanner.Err()
+}
+
+// shortID truncates an ID the way the docker cli does
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	if id == "" {
+		return "-"
+	}
+	return id
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/gopher-net/macvlan-docker-plugin/macvlan"
+)
+
+// healthCommand queries the admin /healthz for HEALTHCHECK lines, exiting
+// non-zero when the plugin is unreachable or a check fails
+var healthCommand = cli.Command{
+	Name:  "health",
+	Usage: "check a running plugin through its admin socket, the exit status is non-zero when unhealthy",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "admin-socket",
+			Value:  defaultAdminSocket,
+			Usage:  "admin socket of the plugin --admin-socket",
+			EnvVar: "MACVLAN_ADMIN_SOCKET",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Value: 5 * time.Second,
+			Usage: "how long to wait for the plugin to answer",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the health report as JSON",
+		},
+	},
+	Action: func(ctx *cli.Context) {
+		report, err := queryHealth(ctx.String("admin-socket"), ctx.Duration("timeout"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "health check failed: %s\n", err)
+			os.Exit(1)
+		}
+		if ctx.Bool("json") {
+			json.NewEncoder(os.Stdout).Encode(report)
+		} else {
+			printHealth(report)
+		}
+		if !report.Healthy {
+			os.Exit(1)
+		}
+	},
+}
+
+func queryHealth(path string, timeout time.Duration) (*macvlan.HealthReport, error) {
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", path)
+			},
+		},
+	}
+	resp, err := client.Get("http://admin/healthz")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	report := &macvlan.HealthReport{}
+	if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+		return nil, fmt.Errorf("invalid /healthz response [ %s ]: %s", resp.Status, err)
+	}
+	return report, nil
+}
+
+func printHealth(report *macvlan.HealthReport) {
+	for _, c := range report.Checks {
+		if c.Healthy {
+			fmt.Printf("%-11s ok\n", c.Name)
+		} else {
+			fmt.Printf("%-11s failed: %s\n", c.Name, c.Error)
+		}
+	}
+	for _, p := range report.Parents {
+		state := "down"
+		if p.Up {
+			state = "up"
+		}
+		if p.Degraded {
+			state += ", degraded"
+		}
+		fmt.Printf("parent [ %s ] %s, %d networks\n", p.Name, state, len(p.Networks))
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/coreos/go-systemd/activation"
+	"github.com/docker/go-connections/sockets"
+)
+
+const (
+	pluginName      = "macvlan"
+	pluginSockDir   = "/run/docker/plugins"
+	pluginSpecDir   = "/etc/docker/plugins"
+	defaultListen   = "unix://" + pluginSockDir + "/" + pluginName + ".sock"
+	pluginSockGroup = "root"
+)
+
+// pluginSpec is the json spec file dockerd reads to find a TLS enabled plugin
+type pluginSpec struct {
+	Name      string
+	Addr      string
+	TLSConfig *pluginTLSSpec `json:",omitempty"`
+}
+
+// pluginTLSSpec are the client side TLS options dockerd uses to dial the plugin
+type pluginTLSSpec struct {
+	InsecureSkipVerify bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+}
+
+// listener is the socket the plugin API is served on along with any
+// discovery files that need to be removed when the plugin exits
+type listener struct {
+	net.Listener
+	cleanup []string
+}
+
+// Close the socket and remove the discovery files written for it
+func (l *listener) Close() error {
+	err := l.Listener.Close()
+	for _, f := range l.cleanup {
+		if rmErr := os.Remove(f); rmErr != nil && !os.IsNotExist(rmErr) {
+			log.Warnf("unable to remove the plugin file [ %s ]: %s", f, rmErr)
+		}
+	}
+	return err
+}
+
+// newListener parses the --listen address and returns a listener registered
+// with dockerd either by its socket path or a spec file in /etc/docker/plugins
+func newListener(ctx *cli.Context) (*listener, error) {
+	addr := ctx.String("listen")
+	if addr == "" {
+		addr = defaultListen
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address [ %s ]: %s", addr, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		return newUnixListener(u.Path)
+	case "tcp":
+		return newTCPListener(u.Host, ctx)
+	default:
+		return nil, fmt.Errorf("invalid listen address [ %s ], the supported protocols are unix:// and tcp://", addr)
+	}
+}
+
+// newUnixListener creates the plugin socket, or uses the one systemd passed
+// through socket activation. Sockets outside of the docker plugin socket
+// directory are registered with a spec file pointing at them.
+func newUnixListener(path string) (*listener, error) {
+	if path == "" {
+		return nil, fmt.Errorf("a socket path is required for unix listeners. Example: unix://%s/%s.sock", pluginSockDir, pluginName)
+	}
+	ls, err := activatedListener()
+	if err != nil {
+		return nil, err
+	}
+	if ls == nil {
+		if ls, err = unixSocket(path); err != nil {
+			return nil, err
+		}
+	} else if ls.Addr().Network() == "unix" {
+		path = ls.Addr().String()
+	}
+	if filepath.Dir(path) != pluginSockDir || strings.TrimSuffix(filepath.Base(path), ".sock") != pluginName {
+		spec, err := writeSpec(pluginName+".spec", []byte("unix://"+path))
+		if err != nil {
+			ls.Close()
+			return nil, err
+		}
+		ls.cleanup = append(ls.cleanup, spec)
+	}
+	log.Infof("Plugin listening on unix socket [ %s ]", path)
+	return ls, nil
+}
+
+// activatedListener returns the socket passed by a systemd socket unit or
+// nil. The unit owns the socket file so it isn't removed on exit.
+func activatedListener() (*listener, error) {
+	files := activation.Files(true)
+	switch len(files) {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("expected only one socket from systemd, got %d", len(files))
+	}
+	l, err := net.FileListener(files[0])
+	files[0].Close()
+	if err != nil {
+		return nil, fmt.Errorf("unable to use the systemd activated socket: %s", err)
+	}
+	log.Infof("Using the systemd activated socket [ %s ]", l.Addr())
+	return &listener{Listener: l}, nil
+}
+
+func unixSocket(path string) (*listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// managed plugin rootfs images may not ship an /etc/group to resolve the socket group from
+	group := pluginSockGroup
+	if _, err := os.Stat("/etc/group"); os.IsNotExist(err) {
+		group = ""
+	}
+	l, err := sockets.NewUnixSocket(path, group)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create the plugin socket [ %s ]: %s", path, err)
+	}
+	return &listener{Listener: l, cleanup: []string{path}}, nil
+}
+
+// newTCPListener creates a TCP listener for dockerd running in another netns
+// or host. When TLS is enabled dockerd clients must present a certificate
+// signed by the --tls-cacert authority.
+func newTCPListener(hostPort string, ctx *cli.Context) (*listener, error) {
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		return nil, fmt.Errorf("invalid tcp listen address [ %s ]: %s", hostPort, err)
+	}
+	tlsConfig, err := serverTLSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSpecTLS(ctx, hostPort, tlsConfig != nil); err != nil {
+		return nil, err
+	}
+	l, err := sockets.NewTCPSocket(hostPort, tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on [ %s ]: %s", hostPort, err)
+	}
+	ls := &listener{Listener: l}
+	advertise := ctx.String("advertise-addr")
+	if advertise == "" {
+		advertise = l.Addr().String()
+	}
+	var spec string
+	if tlsConfig == nil {
+		spec, err = writeSpec(pluginName+".spec", []byte("tcp://"+advertise))
+	} else {
+		serverCA := ctx.String("tls-server-ca")
+		if serverCA == "" {
+			serverCA = ctx.String("tls-cacert")
+		}
+		spec, err = writeJSONSpec(&pluginSpec{
+			Name: pluginName,
+			Addr: "tcp://" + advertise,
+			TLSConfig: &pluginTLSSpec{
+				CAFile:   serverCA,
+				CertFile: ctx.String("tls-client-cert"),
+				KeyFile:  ctx.String("tls-client-key"),
+			},
+		})
+	}
+	if err != nil {
+		ls.Close()
+		return nil, err
+	}
+	ls.cleanup = append(ls.cleanup, spec)
+	log.Infof("Plugin listening on tcp [ %s ] advertised as [ %s ] TLS enabled: [ %t ]", l.Addr().String(), advertise, tlsConfig != nil)
+	return ls, nil
+}
+
+// checkSpecTLS rejects spec files dockerd could never connect with. A plugin
+// verifying client certificates needs the one dockerd presents, and dockerd
+// can't verify the plugin certificate against an unspecified listen address.
+func checkSpecTLS(ctx *cli.Context, hostPort string, tlsEnabled bool) error {
+	clientCert, clientKey := ctx.String("tls-client-cert"), ctx.String("tls-client-key")
+	if (clientCert == "") != (clientKey == "") {
+		return fmt.Errorf("both --tls-client-cert and --tls-client-key are required for dockerd to present a certificate")
+	}
+	if !tlsEnabled {
+		return nil
+	}
+	if ctx.String("tls-cacert") != "" && clientCert == "" {
+		return fmt.Errorf("--tls-cacert requires client certificates, set --tls-client-cert and --tls-client-key for dockerd to present")
+	}
+	if advertise := ctx.String("advertise-addr"); advertise != "" {
+		if _, _, err := net.SplitHostPort(advertise); err != nil {
+			return fmt.Errorf("invalid --advertise-addr [ %s ]: %s", advertise, err)
+		}
+		return nil
+	}
+	host, _, _ := net.SplitHostPort(hostPort)
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return fmt.Errorf("tcp listen address [ %s ] is unspecified, set --advertise-addr to the address in the plugin certificate", hostPort)
+	}
+	return nil
+}
+
+// serverTLSConfig returns nil when TLS is not configured
+func serverTLSConfig(ctx *cli.Context) (*tls.Config, error) {
+	cert, key, ca := ctx.String("tls-cert"), ctx.String("tls-key"), ctx.String("tls-cacert")
+	if cert == "" && key == "" && ca == "" {
+		return nil, nil
+	}
+	if cert == "" || key == "" {
+		return nil, fmt.Errorf("both --tls-cert and --tls-key are required to enable TLS")
+	}
+	keyPair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the TLS key pair [ %s, %s ]: %s", cert, key, err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		MinVersion:   tls.VersionTLS12,
+	}
+	// Verify dockerd client certificates against the CA when one is passed
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the TLS CA [ %s ]: %s", ca, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in the TLS CA [ %s ]", ca)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func writeJSONSpec(spec *pluginSpec) (string, error) {
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+	return writeSpec(spec.Name+".json", b)
+}
+
+// writeSpec writes a discovery file into the docker plugin spec directory
+func writeSpec(name string, content []byte) (string, error) {
+	if err := os.MkdirAll(pluginSpecDir, 0755); err != nil {
+		return "", err
+	}
+	spec := filepath.Join(pluginSpecDir, name)
+	if err := ioutil.WriteFile(spec, content, 0644); err != nil {
+		return "", fmt.Errorf("unable to write the plugin spec [ %s ]: %s", spec, err)
+	}
+	return spec, nil
+}
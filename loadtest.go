@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codegangsta/cli"
+	sdk "github.com/docker/go-plugins-helpers/network"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	pluginContentType = "application/vnd.docker.plugins.v1+json"
+	loadtestTimeout   = 30 * time.Second
+	// loadtestErrorSamples caps the error messages kept per operation
+	loadtestErrorSamples = 3
+)
+
+// the calls of one loadtest sequence, in order
+var loadtestOps = []string{"CreateNetwork", "CreateEndpoint", "Join", "Leave", "DeleteEndpoint", "DeleteNetwork"}
+
+// loadtestCommand drives the plugin API like libnetwork does and reports latencies
+var loadtestCommand = cli.Command{
+	Name:  "loadtest",
+	Usage: "run CreateNetwork/CreateEndpoint/Join/Leave/DeleteEndpoint/DeleteNetwork sequences against a running plugin",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "plugin",
+			Value: defaultListen,
+			Usage: "plugin API address [unix:///path/to.sock|tcp://addr:port]",
+		},
+		cli.StringFlag{
+			Name:  "host-iface",
+			Usage: "parent interface of the test networks, must exist on the plugin host",
+		},
+		cli.StringFlag{
+			Name:  "subnet",
+			Value: "10.222.0.0/16",
+			Usage: "subnet of the test networks, each sequence gets its own address",
+		},
+		cli.StringSliceFlag{
+			Name:  "opt",
+			Value: &cli.StringSlice{},
+			Usage: "extra network option key=value, repeatable",
+		},
+		cli.IntFlag{
+			Name:  "iterations, n",
+			Value: 100,
+			Usage: "number of sequences to run",
+		},
+		cli.IntFlag{
+			Name:  "concurrency, c",
+			Value: 10,
+			Usage: "number of sequences running in parallel",
+		},
+		cli.DurationFlag{
+			Name:  "duration",
+			Usage: "soak mode, run sequences until the duration elapses instead of --iterations",
+		},
+	},
+	Action: func(ctx *cli.Context) {
+		if err := runLoadtest(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "loadtest failed: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// loadtestStats collects the latencies and errors of one operation
+type loadtestStats struct {
+	sync.Mutex
+	latencies []time.Duration
+	errors    int
+	samples   []string
+}
+
+func (s *loadtestStats) record(d time.Duration, err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.latencies = append(s.latencies, d)
+	if err != nil {
+		s.errors++
+		if len(s.samples) < loadtestErrorSamples {
+			s.samples = append(s.samples, err.Error())
+		}
+	}
+}
+
+func (s *loadtestStats) percentile(p float64) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	return s.latencies[int(p*float64(len(s.latencies)-1))]
+}
+
+// pluginClient posts remote driver requests to the plugin socket
+type pluginClient struct {
+	base   string
+	client *http.Client
+}
+
+func newPluginClient(addr string) (*pluginClient, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "unix":
+		transport := &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", u.Path)
+			},
+		}
+		return &pluginClient{base: "http://plugin", client: &http.Client{Transport: transport, Timeout: loadtestTimeout}}, nil
+	case "tcp":
+		return &pluginClient{base: "http://" + u.Host, client: &http.Client{Timeout: loadtestTimeout}}, nil
+	}
+	return nil, fmt.Errorf("invalid --plugin [ %s ], expected unix:// or tcp://", addr)
+}
+
+// post sends a raw request body to a plugin API path
+func (c *pluginClient) post(path string, body []byte) (int, []byte, error) {
+	resp, err := c.client.Post(c.base+path, pluginContentType, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, b, err
+}
+
+// call posts a NetworkDriver request and decodes the libnetwork error response
+func (c *pluginClient) call(method string, req interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	status, b, err := c.post("/NetworkDriver."+method, body)
+	if err != nil {
+		return err
+	}
+	res := &sdk.ErrorResponse{}
+	json.Unmarshal(b, res)
+	if res.Err != "" {
+		return fmt.Errorf("%s", res.Err)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("%s returned [ %d ]", method, status)
+	}
+	return nil
+}
+
+func randomID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// subnetHost returns the n-th address of the subnet
+func subnetHost(subnet *net.IPNet, n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(subnet.IP.To4())+n)
+	return ip
+}
+
+// sequenceAddress returns the address of the i-th sequence. Concurrent
+// sequences get different addresses since the driver derives the endpoint
+// mac from it and rejects duplicate macs on a parent.
+func sequenceAddress(subnet *net.IPNet, i int) *net.IPNet {
+	ones, bits := subnet.Mask.Size()
+	// skip the network, gateway and broadcast addresses
+	hosts := uint32(1)<<uint(bits-ones) - 3
+	return &net.IPNet{IP: subnetHost(subnet, 2+uint32(i)%hosts), Mask: subnet.Mask}
+}
+
+// runSequence runs one network lifecycle, stopping at the first error but
+// always deleting what was created
+func runSequence(c *pluginClient, stats map[string]*loadtestStats, subnet *net.IPNet, gateway string, opts map[string]interface{}, i int) {
+	nid, eid := randomID(), randomID()
+	reqs := map[string]interface{}{
+		"CreateNetwork": &sdk.CreateNetworkRequest{
+			NetworkID: nid,
+			Options:   map[string]interface{}{"com.docker.network.generic": opts},
+			IPv4Data:  []*sdk.IPAMData{{AddressSpace: "LocalDefault", Pool: subnet.String(), Gateway: gateway}},
+		},
+		"CreateEndpoint": &sdk.CreateEndpointRequest{
+			NetworkID:  nid,
+			EndpointID: eid,
+			Interface:  &sdk.EndpointInterface{Address: sequenceAddress(subnet, i).String()},
+		},
+		"Join": &sdk.JoinRequest{
+			NetworkID:  nid,
+			EndpointID: eid,
+			SandboxKey: dockerNetnsDir + "/loadtest-" + eid[:12],
+		},
+		"Leave":          &sdk.LeaveRequest{NetworkID: nid, EndpointID: eid},
+		"DeleteEndpoint": &sdk.DeleteEndpointRequest{NetworkID: nid, EndpointID: eid},
+		"DeleteNetwork":  &sdk.DeleteNetworkRequest{NetworkID: nid},
+	}
+	failed := false
+	for _, op := range loadtestOps {
+		// cleanup calls run even after a failure, like libnetwork rolling back
+		if failed && !strings.HasPrefix(op, "Delete") {
+			continue
+		}
+		start := time.Now()
+		err := c.call(op, reqs[op])
+		stats[op].record(time.Since(start), err)
+		if err != nil {
+			failed = true
+		}
+	}
+}
+
+// hostLinks returns the names of the macvlan links on a parent
+func hostLinks(parent string) (map[string]bool, error) {
+	p, err := netlink.LinkByName(parent)
+	if err != nil {
+		return nil, err
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, link := range links {
+		if link.Attrs().ParentIndex == p.Attrs().Index && (link.Type() == "macvlan" || link.Type() == "macvtap") {
+			names[link.Attrs().Name] = true
+		}
+	}
+	return names, nil
+}
+
+func runLoadtest(ctx *cli.Context) error {
+	parent := ctx.String("host-iface")
+	if parent == "" {
+		return fmt.Errorf("--host-iface is required")
+	}
+	ip, subnet, err := net.ParseCIDR(ctx.String("subnet"))
+	if err != nil || ip.To4() == nil {
+		return fmt.Errorf("invalid --subnet [ %s ], expected an IPv4 cidr", ctx.String("subnet"))
+	}
+	if ones, _ := subnet.Mask.Size(); ones > 29 {
+		return fmt.Errorf("--subnet [ %s ] is too small", subnet)
+	}
+	gateway := subnetHost(subnet, 1).String()
+	opts := map[string]interface{}{"host_iface": parent}
+	for _, opt := range ctx.StringSlice("opt") {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid --opt [ %s ], expected key=value", opt)
+		}
+		opts[kv[0]] = kv[1]
+	}
+	concurrency, iterations, duration := ctx.Int("concurrency"), ctx.Int("iterations"), ctx.Duration("duration")
+	if concurrency < 1 || (duration == 0 && iterations < 1) {
+		return fmt.Errorf("--concurrency and --iterations must be at least 1")
+	}
+	c, err := newPluginClient(ctx.String("plugin"))
+	if err != nil {
+		return err
+	}
+	before, err := hostLinks(parent)
+	if err != nil {
+		return fmt.Errorf("unable to list the links of [ %s ], loadtest has to run on the plugin host: %s", parent, err)
+	}
+	stats := make(map[string]*loadtestStats, len(loadtestOps))
+	for _, op := range loadtestOps {
+		stats[op] = &loadtestStats{}
+	}
+
+	var next int64 = -1
+	deadline := time.Now().Add(duration)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if (duration > 0 && time.Now().After(deadline)) || (duration == 0 && i >= iterations) {
+					return
+				}
+				runSequence(c, stats, subnet, gateway, opts, i)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// links are deleted asynchronously by the events watcher in some paths
+	time.Sleep(time.Second)
+	after, err := hostLinks(parent)
+	if err != nil {
+		return err
+	}
+	var leaked []string
+	for name := range after {
+		if !before[name] {
+			leaked = append(leaked, name)
+		}
+	}
+	sort.Strings(leaked)
+
+	sequences := len(stats["CreateNetwork"].latencies)
+	fmt.Printf("%d sequences in %s with concurrency %d, %.1f sequences/s\n\n", sequences, elapsed, concurrency, float64(sequences)/elapsed.Seconds())
+	fmt.Printf("%-16s %8s %8s %10s %10s %10s %10s\n", "operation", "calls", "errors", "p50", "p90", "p99", "max")
+	totalErrors := 0
+	for _, op := range loadtestOps {
+		s := stats[op]
+		sort.Sort(durations(s.latencies))
+		fmt.Printf("%-16s %8d %8d %10s %10s %10s %10s\n", op, len(s.latencies), s.errors,
+			s.percentile(0.5), s.percentile(0.9), s.percentile(0.99), s.percentile(1))
+		totalErrors += s.errors
+	}
+	for _, op := range loadtestOps {
+		for _, msg := range stats[op].samples {
+			fmt.Printf("\n%s error: %s", op, msg)
+		}
+	}
+	fmt.Printf("\nleaked host links on [ %s ]: %d", parent, len(leaked))
+	if len(leaked) > 0 {
+		fmt.Printf(" [ %s ]", strings.Join(leaked, " "))
+	}
+	fmt.Println()
+	if totalErrors > 0 || len(leaked) > 0 {
+		return fmt.Errorf("%d errors, %d leaked links", totalErrors, len(leaked))
+	}
+	return nil
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	stdlog "log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+// setupLogging applies the --debug, --log-format and --log-file flags
+func setupLogging(ctx *cli.Context) error {
+	if ctx.Bool("debug") {
+		log.SetLevel(log.DebugLevel)
+	}
+	switch format := ctx.String("log-format"); format {
+	case "", "text":
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid --log-format [ %s ], expected text or json", format)
+	}
+	// the plugin helpers log each request with the standard logger
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(log.StandardLogger().Writer())
+	path := ctx.String("log-file")
+	if path == "" {
+		return nil
+	}
+	maxSize, keep := ctx.Int("log-max-size"), ctx.Int("log-max-files")
+	if maxSize < 1 || keep < 0 {
+		return fmt.Errorf("--log-max-size must be at least 1 MB and --log-max-files can't be negative")
+	}
+	f, err := openRotatingFile(path, int64(maxSize)<<20, keep)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(f)
+	return nil
+}
+
+// rotatingFile is a log file moved to <path>.1 once it reaches maxSize,
+// shifting the older files up to <path>.<keep>
+type rotatingFile struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("unable to open the log file [ %s ]: %s", f.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends a log line, rotating first if the line would go over maxSize
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			// keep logging to the full file rather than losing lines
+			fmt.Fprintf(os.Stderr, "unable to rotate the log file [ %s ]: %s\n", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.keep == 0 {
+		os.Remove(f.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", f.path, f.keep))
+		for i := f.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		os.Rename(f.path, f.path+".1")
+	}
+	return f.open()
+}
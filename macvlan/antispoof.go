@@ -0,0 +1,548 @@
+package macvlan
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	// clsact qdisc handle and its egress hook, tc qdisc add dev X clsact
+	clsactHandle = 0xFFFF0000
+	clsactParent = netlink.HANDLE_INGRESS
+	clsactEgress = 0xFFFFFFF3
+
+	// filters sharing a priority must match the same protocol, the drop
+	// filter has the highest priority value so it is evaluated last
+	antiSpoofDropPrio = 100
+	// the filters on the parent egress are offset above the priorities tc
+	// picks for filters added without one, which count down from 0xC000
+	parentAntiSpoofPrio = 0xF000
+	// the parent guard passes the other sources on the parent after the
+	// endpoint filters and drops the rest
+	parentGuardPassPrio = parentAntiSpoofPrio + 2*antiSpoofDropPrio
+	parentGuardDropPrio = parentAntiSpoofPrio + 3*antiSpoofDropPrio
+
+	ethPAll  = 0x0003
+	ethPIP   = 0x0800
+	ethPARP  = 0x0806
+	ethPIPv6 = 0x86DD
+
+	// u32 key offsets relative to the network header
+	ethSrcOffset    = -8
+	ipv4SrcOffset   = 12
+	ipv6SrcOffset   = 8
+	arpSenderOffset = 8
+
+	// linux/tc_act/tc_gact.h and linux/gen_stats.h values missing from the vendored nl package
+	tcaGactParms    = 2
+	tcaActStats     = 4
+	tcaStatsBasic   = 1
+	nlaTypeMask     = 0x3FFF
+	sizeofTcGactGen = 20
+
+	infoAntiSpoof      = "anti_spoof"
+	infoDroppedPackets = "anti_spoof_dropped_packets"
+	infoDroppedBytes   = "anti_spoof_dropped_bytes"
+)
+
+var antiSpoofPassPrio = map[uint16]uint16{ethPIP: 1, ethPARP: 2, ethPIPv6: 3}
+
+// antiSpoofHook returns the sandbox hook that drops frames the container
+// sends with a source mac or address other than the ones assigned to the
+// endpoint. The filters sit on the egress hook of a clsact qdisc so they
+// don't conflict with an egress tbf root qdisc. They complement the parent
+// filters with the frames sent to other links on the same parent.
+func (ep *endpoint) antiSpoofHook() sandboxHook {
+	return func(l *callLog, link netlink.Link) error {
+		return addU32Filters(l, link, ep.antiSpoofFilters())
+	}
+}
+
+// antiSpoofTeardown deletes the clsact qdisc along with the filters on it
+func antiSpoofTeardown(l *callLog, link netlink.Link) error {
+	err := l.audit(auditQdiscDel, link.Attrs().Name, "clsact", netlink.QdiscDel(clsact(link)))
+	if err != nil && err != syscall.ENOENT && err != syscall.EINVAL {
+		return fmt.Errorf("unable to delete the clsact qdisc of [ %s ]: %s", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// addParentAntiSpoof enforces the endpoint addresses on the egress of the
+// parent before the link is moved. Unlike the sandbox filters they are out of
+// reach of the container. Sources the endpoint filters don't cover are
+// dropped by the parent guard.
+func (ep *endpoint) addParentAntiSpoof(l *callLog, parent netlink.Link) error {
+	if err := addU32Filters(l, parent, ep.parentAntiSpoofFilters()); err != nil {
+		if delErr := ep.deleteParentAntiSpoof(l, parent); delErr != nil {
+			l.Errorf("Unable to remove the anti spoofing filters of [ %s ] from [ %s ]: %s", ep.id, parent.Attrs().Name, delErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// deleteParentAntiSpoof deletes the parent filters of the endpoint, found by
+// their keys since the kernel picks the filter handles. The clsact qdisc is
+// left for the other endpoints and filters on the parent.
+func (ep *endpoint) deleteParentAntiSpoof(l *callLog, parent netlink.Link) error {
+	installed, err := u32Filters(parent)
+	if err != nil {
+		return fmt.Errorf("unable to list the filters of [ %s ]: %s", parent.Attrs().Name, err)
+	}
+	for _, f := range installed {
+		if !f.in(ep.parentAntiSpoofFilters()) {
+			continue
+		}
+		if err := deleteU32Filter(l, parent, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncParentGuard makes the parent guard match the endpoints on the parent.
+// Frames an endpoint sends with a source the endpoint filters don't know,
+// such as a mac the container picked, only meet the sandbox filters once
+// they are installed after the move. Until the last endpoint filters are
+// removed the guard passes the parent mac and the macs of the other links
+// and endpoints on the parent, and drops every other source.
+func (d *Driver) syncParentGuard(l *callLog, parent netlink.Link) error {
+	installed, err := u32Filters(parent)
+	if err != nil {
+		return fmt.Errorf("unable to list the filters of [ %s ]: %s", parent.Attrs().Name, err)
+	}
+	var want []u32Filter
+	for _, f := range installed {
+		if f.prio == parentAntiSpoofPrio+antiSpoofDropPrio {
+			if want, err = d.parentGuardFilters(parent); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	var current []u32Filter
+	for _, f := range installed {
+		if f.prio != parentGuardPassPrio && f.prio != parentGuardDropPrio {
+			continue
+		}
+		if !f.in(want) {
+			if err := deleteU32Filter(l, parent, f); err != nil {
+				return err
+			}
+			continue
+		}
+		current = append(current, f.u32Filter)
+	}
+	var missing []u32Filter
+	for _, f := range want {
+		if !f.in(current) {
+			missing = append(missing, f)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return addU32Filters(l, parent, missing)
+}
+
+// parentGuardFilters lists the filters passing the parent mac, the macs of
+// the endpoints without anti spoofing and of the other links on the parent,
+// followed by a match all filter dropping everything else
+func (d *Driver) parentGuardFilters(parent netlink.Link) ([]u32Filter, error) {
+	allowed := map[string]net.HardwareAddr{parent.Attrs().HardwareAddr.String(): parent.Attrs().HardwareAddr}
+	guarded := make(map[string]bool)
+	for _, n := range d.getNetworks() {
+		if n.ifaceOpt != parent.Attrs().Name {
+			continue
+		}
+		for _, ep := range n.getEndpoints() {
+			if ep.antiSpoof {
+				guarded[ep.mac.String()] = true
+			} else if ep.mac != nil {
+				allowed[ep.mac.String()] = ep.mac
+			}
+		}
+	}
+	links, err := linkOps.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the links on [ %s ]: %s", parent.Attrs().Name, err)
+	}
+	for _, link := range links {
+		mac := link.Attrs().HardwareAddr
+		if link.Attrs().ParentIndex == parent.Attrs().Index && len(mac) == 6 && !guarded[mac.String()] {
+			allowed[mac.String()] = mac
+		}
+	}
+	var filters []u32Filter
+	for _, mac := range allowed {
+		if len(mac) != 6 {
+			continue
+		}
+		filters = append(filters, u32Filter{
+			prio:   parentGuardPassPrio,
+			proto:  ethPAll,
+			keys:   macKeys(ethSrcOffset, mac),
+			action: nl.TC_ACT_OK,
+		})
+	}
+	return append(filters, u32Filter{
+		prio:   parentGuardDropPrio,
+		proto:  ethPAll,
+		keys:   []nl.TcU32Key{{}},
+		action: nl.TC_ACT_SHOT,
+	}), nil
+}
+
+// deleteU32Filter deletes an installed filter from the egress hook of a link
+func deleteU32Filter(l *callLog, link netlink.Link, f installedU32) error {
+	filter := &netlink.U32{FilterAttrs: netlink.FilterAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    f.handle,
+		Parent:    clsactEgress,
+		Priority:  f.prio,
+		Protocol:  f.proto,
+	}}
+	err := l.audit(auditFilterDel, link.Attrs().Name, f.String(), netlink.FilterDel(filter))
+	if err != nil && err != syscall.ENOENT {
+		return fmt.Errorf("unable to delete the anti spoofing filters from [ %s ]: %s", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// addU32Filters adds the filters to the egress hook of the link clsact qdisc
+func addU32Filters(l *callLog, link netlink.Link, filters []u32Filter) error {
+	if err := l.audit(auditQdiscAdd, link.Attrs().Name, "clsact", netlink.QdiscAdd(clsact(link))); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("unable to add the clsact qdisc to [ %s ]: %s", link.Attrs().Name, err)
+	}
+	for _, f := range filters {
+		if err := l.audit(auditFilterAdd, link.Attrs().Name, f.String(), u32FilterAdd(link, f.prio, f.proto, f.keys, f.action)); err != nil {
+			return fmt.Errorf("unable to add the anti spoofing filters to [ %s ]: %s", link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+func clsact(link netlink.Link) *netlink.GenericQdisc {
+	return &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    clsactHandle,
+			Parent:    clsactParent,
+		},
+		QdiscType: "clsact",
+	}
+}
+
+type u32Filter struct {
+	prio   uint16
+	proto  uint16
+	keys   []nl.TcU32Key
+	action int32
+}
+
+func (f u32Filter) String() string {
+	return fmt.Sprintf("u32 prio %d protocol 0x%04x action %d", f.prio, f.proto, f.action)
+}
+
+// in reports whether one of filters has the same priority, protocol and keys
+func (f u32Filter) in(filters []u32Filter) bool {
+	for _, other := range filters {
+		if other.prio != f.prio || other.proto != f.proto || len(other.keys) != len(f.keys) {
+			continue
+		}
+		match := true
+		for i := range f.keys {
+			match = match && f.keys[i] == other.keys[i]
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// antiSpoofFilters lists the frames the endpoint is allowed to send
+// followed by a match all filter dropping everything else
+func (ep *endpoint) antiSpoofFilters() []u32Filter {
+	return append(ep.antiSpoofPass(0), u32Filter{
+		prio:   antiSpoofDropPrio,
+		proto:  ethPAll,
+		keys:   []nl.TcU32Key{{}},
+		action: nl.TC_ACT_SHOT,
+	})
+}
+
+// parentAntiSpoofFilters lists the frames the endpoint is allowed to send
+// followed by filters dropping the other frames sent with the endpoint mac,
+// and the frames sent with the endpoint addresses from another mac. The
+// parent is shared with the host and other endpoints so nothing else is dropped.
+func (ep *endpoint) parentAntiSpoofFilters() []u32Filter {
+	filters := ep.antiSpoofPass(parentAntiSpoofPrio)
+	drop := func(proto uint16, keys ...nl.TcU32Key) {
+		prio := parentAntiSpoofPrio + antiSpoofDropPrio + antiSpoofPassPrio[proto]
+		filters = append(filters, u32Filter{prio: prio, proto: proto, keys: keys, action: nl.TC_ACT_SHOT})
+	}
+	drop(ethPAll, macKeys(ethSrcOffset, ep.mac)...)
+	if ep.addr != nil {
+		ip := ep.addr.IP.To4()
+		drop(ethPIP, u32Key(ipv4SrcOffset, ip, nil))
+		// the arp sender protocol address straddles two keys
+		drop(ethPARP, u32Key(arpSenderOffset+4, []byte{0, 0, ip[0], ip[1]}, []byte{0, 0, 0xff, 0xff}),
+			u32Key(arpSenderOffset+8, ip[2:4], []byte{0xff, 0xff, 0, 0}))
+	}
+	if ep.addrv6 != nil {
+		drop(ethPIPv6, ipv6Keys(ep.addrv6.IP, net.CIDRMask(128, 128))...)
+	}
+	return filters
+}
+
+// antiSpoofPass lists the filters passing the frames the endpoint is
+// allowed to send, at priorities offset by base
+func (ep *endpoint) antiSpoofPass(base uint16) []u32Filter {
+	src := macKeys(ethSrcOffset, ep.mac)
+	var filters []u32Filter
+	pass := func(proto uint16, keys ...nl.TcU32Key) {
+		filters = append(filters, u32Filter{
+			prio:   base + antiSpoofPassPrio[proto],
+			proto:  proto,
+			keys:   append(append([]nl.TcU32Key{}, src...), keys...),
+			action: nl.TC_ACT_OK,
+		})
+	}
+	if ep.addr != nil {
+		ip := ep.addr.IP.To4()
+		pass(ethPIP, u32Key(ipv4SrcOffset, ip, nil))
+		// arp sender hardware and protocol addresses
+		sender := append(append([]byte{}, ep.mac...), ip...)
+		pass(ethPARP, u32Key(arpSenderOffset, sender[0:4], nil), u32Key(arpSenderOffset+4, sender[4:8], nil),
+			u32Key(arpSenderOffset+8, sender[8:10], []byte{0xff, 0xff, 0, 0}))
+	}
+	if ep.addrv6 != nil {
+		pass(ethPIPv6, ipv6Keys(ep.addrv6.IP, net.CIDRMask(128, 128))...)
+	}
+	// the EUI-64 link local and unspecified sources are needed for neighbor discovery and DAD
+	pass(ethPIPv6, ipv6Keys(linkLocalEUI64(ep.mac), net.CIDRMask(128, 128))...)
+	pass(ethPIPv6, ipv6Keys(net.IPv6unspecified, net.CIDRMask(128, 128))...)
+	return filters
+}
+
+// linkLocalEUI64 returns the link local address the kernel derives from a mac
+// with the default addr_gen_mode
+func linkLocalEUI64(mac net.HardwareAddr) net.IP {
+	ip := net.ParseIP("fe80::")
+	ip[8], ip[9], ip[10] = mac[0]^0x02, mac[1], mac[2]
+	ip[11], ip[12] = 0xff, 0xfe
+	ip[13], ip[14], ip[15] = mac[3], mac[4], mac[5]
+	return ip
+}
+
+// u32Key matches up to 4 bytes at off from the network header, a nil mask matches all bytes
+func u32Key(off int32, val, mask []byte) nl.TcU32Key {
+	v, m := make([]byte, 4), make([]byte, 4)
+	copy(v, val)
+	if mask == nil {
+		for i := range val {
+			m[i] = 0xff
+		}
+	} else {
+		copy(m, mask)
+	}
+	for i := range v {
+		v[i] &= m[i]
+	}
+	// keys are in network byte order in memory
+	return nl.TcU32Key{
+		Mask: nl.NativeEndian().Uint32(m),
+		Val:  nl.NativeEndian().Uint32(v),
+		Off:  off,
+	}
+}
+
+func macKeys(off int32, mac net.HardwareAddr) []nl.TcU32Key {
+	return []nl.TcU32Key{u32Key(off, mac[0:4], nil), u32Key(off+4, mac[4:6], nil)}
+}
+
+func ipv6Keys(ip net.IP, mask net.IPMask) []nl.TcU32Key {
+	ip = ip.To16()
+	var keys []nl.TcU32Key
+	for i := 0; i < net.IPv6len; i += 4 {
+		keys = append(keys, u32Key(ipv6SrcOffset+int32(i), ip[i:i+4], mask[i:i+4]))
+	}
+	return keys
+}
+
+// u32FilterAdd adds a u32 filter with a gact action to the clsact egress hook.
+// The vendored netlink FilterAdd only supports mirred actions.
+func u32FilterAdd(link netlink.Link, prio, proto uint16, keys []nl.TcU32Key, action int32) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_ACK)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+		Parent:  clsactEgress,
+		Info:    netlink.MakeHandle(prio, nl.Swap16(proto)),
+	})
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("u32")))
+	options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+	sel := nl.TcU32Sel{
+		Flags: nl.TC_U32_TERMINAL,
+		Nkeys: uint8(len(keys)),
+		Keys:  keys,
+	}
+	nl.NewRtAttrChild(options, nl.TCA_U32_SEL, sel.Serialize())
+	actions := nl.NewRtAttrChild(options, nl.TCA_U32_ACT, nil)
+	table := nl.NewRtAttrChild(actions, nl.TCA_ACT_TAB, nil)
+	nl.NewRtAttrChild(table, nl.TCA_KIND, nl.ZeroTerminated("gact"))
+	aopts := nl.NewRtAttrChild(table, nl.TCA_OPTIONS, nil)
+	// struct tc_gact is the tc_gen index, capab, action, refcnt and bindcnt
+	parms := make([]byte, sizeofTcGactGen)
+	nl.NativeEndian().PutUint32(parms[8:], uint32(action))
+	nl.NewRtAttrChild(aopts, tcaGactParms, parms)
+	req.AddData(options)
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// installedU32 is a u32 filter on the egress hook of a link along with the
+// stats of its action
+type installedU32 struct {
+	u32Filter
+	handle         uint32
+	packets, bytes uint64
+}
+
+// u32Filters lists the u32 filters on the clsact egress hook of a link. The
+// vendored netlink FilterList doesn't return the keys or the gact stats.
+func u32Filters(link netlink.Link) ([]installedU32, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETTFILTER, syscall.NLM_F_DUMP)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+		Parent:  clsactEgress,
+	})
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWTFILTER)
+	if err != nil {
+		return nil, err
+	}
+	var filters []installedU32
+	for _, m := range msgs {
+		msg := nl.DeserializeTcMsg(m)
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, err
+		}
+		// the hash table entries of a u32 filter have no selector
+		sels := nestedAttrs(attrs, nl.TCA_OPTIONS, nl.TCA_U32_SEL)
+		if len(sels) == 0 || len(sels[0].Value) < nl.SizeofTcU32Sel {
+			continue
+		}
+		sel := nl.DeserializeTcU32Sel(sels[0].Value)
+		f := installedU32{
+			u32Filter: u32Filter{
+				prio:  uint16(msg.Info >> 16),
+				proto: nl.Swap16(uint16(msg.Info)),
+				keys:  sel.Keys,
+			},
+			handle: msg.Handle,
+		}
+		for _, stats := range nestedAttrs(attrs, nl.TCA_OPTIONS, nl.TCA_U32_ACT, nl.TCA_ACT_TAB, tcaActStats, tcaStatsBasic) {
+			// struct gnet_stats_basic is a u64 byte count followed by a u32 packet count
+			if len(stats.Value) < 12 {
+				continue
+			}
+			f.bytes += nl.NativeEndian().Uint64(stats.Value[0:8])
+			f.packets += uint64(nl.NativeEndian().Uint32(stats.Value[8:12]))
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// antiSpoofDrops returns the packets and bytes dropped by the filters of a
+// link that are in drops
+func antiSpoofDrops(link netlink.Link, drops []u32Filter) (packets, bytes uint64, err error) {
+	installed, err := u32Filters(link)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, f := range installed {
+		if f.in(drops) {
+			packets += f.packets
+			bytes += f.bytes
+		}
+	}
+	return packets, bytes, nil
+}
+
+// shotFilters returns the filters dropping frames
+func shotFilters(filters []u32Filter) []u32Filter {
+	var drops []u32Filter
+	for _, f := range filters {
+		if f.action == nl.TC_ACT_SHOT {
+			drops = append(drops, f)
+		}
+	}
+	return drops
+}
+
+// nestedAttrs walks down nested netlink attributes by type
+func nestedAttrs(attrs []syscall.NetlinkRouteAttr, path ...uint16) []syscall.NetlinkRouteAttr {
+	if len(path) == 0 {
+		return attrs
+	}
+	var found []syscall.NetlinkRouteAttr
+	for _, a := range attrs {
+		if a.Attr.Type&nlaTypeMask != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			found = append(found, a)
+			continue
+		}
+		children, err := nl.ParseRouteAttr(a.Value)
+		if err != nil {
+			continue
+		}
+		found = append(found, nestedAttrs(children, path[1:]...)...)
+	}
+	return found
+}
+
+// antiSpoofInfo returns the drop counters of an endpoint as reported by
+// EndpointInfo, the sum of the parent and the sandbox filter drops
+func (ep *endpoint) antiSpoofInfo(parent, sandboxKey string) map[string]string {
+	info := map[string]string{infoAntiSpoof: "true"}
+	var packets, bytes uint64
+	err := func() error {
+		if link, err := linkOps.LinkByName(parent); err == nil {
+			p, b, err := antiSpoofDrops(link, shotFilters(ep.parentAntiSpoofFilters()))
+			if err != nil {
+				return err
+			}
+			packets, bytes = packets+p, bytes+b
+		}
+		if sandboxKey == "" {
+			return nil
+		}
+		return inNetns(sandboxKey, func() error {
+			link, err := linkByMac(ep.mac)
+			if err != nil || link == nil {
+				return err
+			}
+			p, b, err := antiSpoofDrops(link, shotFilters(ep.antiSpoofFilters()))
+			packets, bytes = packets+p, bytes+b
+			return err
+		})
+	}()
+	if err != nil {
+		info[infoDroppedPackets] = "unknown: " + err.Error()
+		return info
+	}
+	info[infoDroppedPackets] = strconv.FormatUint(packets, 10)
+	info[infoDroppedBytes] = strconv.FormatUint(bytes, 10)
+	return info
+}
@@ -0,0 +1,145 @@
+package macvlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// host changes recorded in the audit log
+const (
+	auditLinkAdd      = "link_add"
+	auditLinkDel      = "link_del"
+	auditLinkMTU      = "link_mtu"
+	auditLinkUp       = "link_up"
+	auditLinkDown     = "link_down"
+	auditLinkName     = "link_name"
+	auditLinkAlias    = "link_alias"
+	auditLinkMac      = "link_mac"
+	auditLinkMaster   = "link_master"
+	auditLinkNoMaster = "link_nomaster"
+	auditBondMode     = "bond_mode"
+	auditFdbAdd       = "fdb_add"
+	auditFdbDel       = "fdb_del"
+	auditRouteAdd     = "route_add"
+	auditRouteDel     = "route_del"
+	auditRuleAdd      = "rule_add"
+	auditRuleDel      = "rule_del"
+	auditQdiscAdd     = "qdisc_add"
+	auditQdiscReplace = "qdisc_replace"
+	auditQdiscDel     = "qdisc_del"
+	auditFilterAdd    = "filter_add"
+	auditFilterDel    = "filter_del"
+	auditSysctl       = "sysctl"
+
+	auditResultOK = "ok"
+)
+
+// AuditRecord is a host network change made by the driver, one JSON line
+// of the --audit-log file
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// Call is the API call or background task that made the change
+	Call          string `json:"call"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	NetworkID     string `json:"network_id,omitempty"`
+	EndpointID    string `json:"endpoint_id,omitempty"`
+	Sandbox       string `json:"sandbox,omitempty"`
+	Op            string `json:"op"`
+	// Target is the link, route, rule or sysctl changed
+	Target string `json:"target"`
+	Detail string `json:"detail,omitempty"`
+	// Result is ok or the error of the change
+	Result string `json:"result"`
+}
+
+// auditLog is the append only file host changes are recorded in
+type auditLog struct {
+	sync.Mutex
+	file *os.File
+}
+
+// hostAudit is nil unless --audit-log is set
+var hostAudit *auditLog
+
+func openAuditLog(path string) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the audit log [ %s ]: %s", path, err)
+	}
+	return &auditLog{file: file}, nil
+}
+
+// write appends a record as a single write so concurrent records don't interleave
+func (a *auditLog) write(rec *AuditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	a.Lock()
+	defer a.Unlock()
+	_, err = a.file.Write(append(b, '\n'))
+	return err
+}
+
+// audit records a host change made by the call and returns its error
+func (l *callLog) audit(op, target, detail string, err error) error {
+	if hostAudit == nil {
+		return err
+	}
+	rec := &AuditRecord{
+		Time:   time.Now().UTC(),
+		Op:     op,
+		Target: target,
+		Detail: detail,
+		Result: auditResultOK,
+	}
+	rec.Call, _ = l.Data["call"].(string)
+	rec.CorrelationID, _ = l.Data["correlation_id"].(string)
+	rec.NetworkID, _ = l.Data["network_id"].(string)
+	rec.EndpointID, _ = l.Data["endpoint_id"].(string)
+	rec.Sandbox, _ = l.Data["sandbox"].(string)
+	if err != nil {
+		rec.Result = err.Error()
+	}
+	if werr := hostAudit.write(rec); werr != nil {
+		l.Errorf("Unable to write the audit record of [ %s %s ]: %s", op, target, werr)
+	}
+	return err
+}
+
+func tableDetail(table int) string {
+	return fmt.Sprintf("table %d", table)
+}
+
+// linkDetail describes the endpoint links of a network
+func linkDetail(n *network) string {
+	return fmt.Sprintf("%s on %s mode %s", n.linkType, n.ifaceOpt, n.modeOpt)
+}
+
+// routeTarget describes a route the way ip route lists it
+func routeTarget(r *netlink.Route) string {
+	target := "default"
+	if r.Dst != nil {
+		target = r.Dst.String()
+	}
+	if r.Gw != nil {
+		target += " via " + r.Gw.String()
+	}
+	if link, err := linkOps.LinkByIndex(r.LinkIndex); err == nil {
+		target += " dev " + link.Attrs().Name
+	}
+	return target
+}
+
+func ruleTarget(r *netlink.Rule) string {
+	return fmt.Sprintf("from %s priority %d", r.Src, r.Priority)
+}
@@ -0,0 +1,101 @@
+package macvlan
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// tbf queue latency used to size the qdisc limit, same default as tc
+	tbfLatency = 0.05
+	// default burst when only a rate is set, enough for a 1500 MTU at most rates
+	defaultEgressBurst = 32 << 10
+)
+
+// bandwidth is an egress rate limit applied to an endpoint
+type bandwidth struct {
+	rate  uint64 // bytes per second
+	burst uint64 // bytes
+}
+
+// parseBandwidth reads the egress_rate and egress_burst options, falling back to the defaults
+func parseBandwidth(opts map[string]string, defaults *bandwidth) (*bandwidth, error) {
+	bw := &bandwidth{}
+	if defaults != nil {
+		*bw = *defaults
+	}
+	if v, ok := opts[optEgressRate]; ok {
+		rate, err := parseRate(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -o %s: %s", optEgressRate, err)
+		}
+		if rate > math.MaxUint32 {
+			return nil, fmt.Errorf("invalid -o %s: [ %s ] is above the maximum tbf rate of 32gbit", optEgressRate, v)
+		}
+		bw.rate = rate
+	}
+	if v, ok := opts[optEgressBurst]; ok {
+		burst, err := parseSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -o %s: %s", optEgressBurst, err)
+		}
+		bw.burst = burst
+	}
+	if bw.rate == 0 {
+		if bw.burst != 0 {
+			return nil, fmt.Errorf("-o %s requires -o %s to be set", optEgressBurst, optEgressRate)
+		}
+		return nil, nil
+	}
+	if bw.burst == 0 {
+		bw.burst = defaultEgressBurst
+	}
+	return bw, nil
+}
+
+// tbf returns the root qdisc enforcing the limits on a link
+func (bw *bandwidth) tbf(link netlink.Link) *netlink.Tbf {
+	return &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   bw.rate,
+		Limit:  uint32(float64(bw.rate)*tbfLatency) + uint32(bw.burst),
+		Buffer: uint32(netlink.Xmittime(bw.rate, uint32(bw.burst))),
+	}
+}
+
+// hook returns the sandbox hook installing a tbf qdisc as the link root qdisc
+func (bw *bandwidth) hook() sandboxHook {
+	return func(l *callLog, link netlink.Link) error {
+		qdisc := bw.tbf(link)
+		detail := fmt.Sprintf("tbf rate %dbit burst %db", bw.rate*8, bw.burst)
+		if err := l.audit(auditQdiscReplace, link.Attrs().Name, detail, netlink.QdiscReplace(qdisc)); err != nil {
+			return fmt.Errorf("unable to add the egress tbf qdisc to [ %s ]: %s", link.Attrs().Name, err)
+		}
+		return nil
+	}
+}
+
+// teardown deletes the tbf root qdisc, the link falls back to the default qdisc
+func (bw *bandwidth) teardown(l *callLog, link netlink.Link) error {
+	err := l.audit(auditQdiscDel, link.Attrs().Name, "tbf", netlink.QdiscDel(bw.tbf(link)))
+	if err != nil && err != syscall.ENOENT {
+		return fmt.Errorf("unable to delete the egress tbf qdisc of [ %s ]: %s", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// info returns the limits as reported by EndpointInfo
+func (bw *bandwidth) info() map[string]string {
+	return map[string]string{
+		optEgressRate:  strconv.FormatUint(bw.rate*8, 10) + "bit",
+		optEgressBurst: strconv.FormatUint(bw.burst, 10) + "b",
+	}
+}
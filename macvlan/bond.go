@@ -0,0 +1,211 @@
+package macvlan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	optBondSlaves = "bond_slaves"
+	optBondMode   = "bond_mode"
+
+	slaveUp   = "up"
+	slaveDown = "down"
+)
+
+// parseBond reads the -o bond_slaves and -o bond_mode options used to create
+// the bond parent of a network
+func parseBond(opts map[string]string) (slaves []string, mode string, err error) {
+	for _, s := range strings.Split(opts[optBondSlaves], ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			slaves = append(slaves, s)
+		}
+	}
+	mode = opts[optBondMode]
+	if len(slaves) == 0 {
+		if mode != "" {
+			return nil, "", fmt.Errorf("-o %s requires -o %s to be set", optBondMode, optBondSlaves)
+		}
+		return nil, "", nil
+	}
+	if mode != "" && netlink.StringToBondMode(mode) == netlink.BOND_MODE_UNKNOWN {
+		var modes []string
+		for m := range netlink.StringToBondModeMap {
+			modes = append(modes, m)
+		}
+		sort.Strings(modes)
+		return nil, "", fmt.Errorf("invalid -o %s=%s, expected one of %s", optBondMode, mode, strings.Join(modes, ", "))
+	}
+	return slaves, mode, nil
+}
+
+// setupBond creates the bond parent of a network if it doesn't exist and
+// enslaves the -o bond_slaves interfaces. An existing bond is reused, owned
+// reports whether the bond was created by the driver.
+func setupBond(l *callLog, name string, slaves []string, mode string) (owned bool, err error) {
+	link, err := linkOps.LinkByName(name)
+	if err == nil {
+		if _, ok := link.(*netlink.Bond); !ok {
+			return false, fmt.Errorf("-o %s=%s exists and is not a bond", optHostIface, name)
+		}
+		owned = isDriverLink(link)
+	} else {
+		bond := netlink.NewLinkBond(netlink.LinkAttrs{Name: name, TxQLen: -1})
+		if err := l.audit(auditLinkAdd, name, "bond", linkOps.LinkAdd(bond)); err != nil {
+			return false, fmt.Errorf("unable to create the bond [ %s ]: %s", name, err)
+		}
+		if err := markDriverLink(l, bond); err != nil {
+			l.audit(auditLinkDel, name, "bond", linkOps.LinkDel(bond))
+			return false, err
+		}
+		link, owned = bond, true
+		log.Infof("Created the bond [ %s ] with slaves [ %s ]", name, strings.Join(slaves, ","))
+	}
+	if mode != "" {
+		// The vendored netlink bond mode values don't match the kernel ones,
+		// the mode is set through sysfs instead. It can only change while
+		// the bond has no slaves.
+		if err := setBondMode(l, name, mode); err != nil {
+			return owned, err
+		}
+	}
+	for _, s := range slaves {
+		slave, err := linkOps.LinkByName(s)
+		if err != nil {
+			return owned, fmt.Errorf("unable to find the bond slave [ %s ]: %s", s, err)
+		}
+		if slave.Attrs().MasterIndex == link.Attrs().Index {
+			continue
+		}
+		if slave.Attrs().MasterIndex != 0 {
+			return owned, fmt.Errorf("the bond slave [ %s ] is already enslaved to another interface", s)
+		}
+		// links have to be down to be enslaved
+		if err := l.audit(auditLinkDown, s, "", linkOps.LinkSetDown(slave)); err != nil {
+			return owned, fmt.Errorf("unable to bring down the bond slave [ %s ]: %s", s, err)
+		}
+		if err := l.audit(auditLinkMaster, s, name, linkOps.LinkSetMasterByIndex(slave, link.Attrs().Index)); err != nil {
+			return owned, fmt.Errorf("unable to add the slave [ %s ] to the bond [ %s ]: %s", s, name, err)
+		}
+	}
+	if err := l.audit(auditLinkUp, name, "", linkOps.LinkSetUp(link)); err != nil {
+		return owned, fmt.Errorf("unable to bring up the bond [ %s ]: %s", name, err)
+	}
+	return owned, nil
+}
+
+func setBondMode(l *callLog, name, mode string) error {
+	path := fmt.Sprintf("/sys/class/net/%s/bonding/mode", name)
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read the mode of the bond [ %s ]: %s", name, err)
+	}
+	// the file contains the mode name followed by its number
+	if fields := strings.Fields(string(current)); len(fields) > 0 && fields[0] == mode {
+		return nil
+	}
+	if err := l.audit(auditBondMode, name, mode, ioutil.WriteFile(path, []byte(mode), 0644)); err != nil {
+		return fmt.Errorf("unable to set the mode of the bond [ %s ] to [ %s ], it can't change while the bond has slaves: %s", name, mode, err)
+	}
+	return nil
+}
+
+// deleteBond deletes a bond created by the driver, releasing its slaves.
+// Bonds the operator created are left alone.
+func deleteBond(l *callLog, name string) {
+	link, err := linkOps.LinkByName(name)
+	if err != nil {
+		return
+	}
+	if _, ok := link.(*netlink.Bond); !ok || !isDriverLink(link) {
+		return
+	}
+	if err := l.audit(auditLinkDel, name, "bond", linkOps.LinkDel(link)); err != nil {
+		log.Errorf("Unable to delete the bond [ %s ]: %s", name, err)
+		return
+	}
+	log.Infof("Deleted the bond [ %s ]", name)
+}
+
+// parentSlaves returns the kind of an aggregate parent, bond or team, and
+// the state of its slaves. Other parents have no slaves.
+func parentSlaves(name string) (string, map[string]string, error) {
+	parent, err := linkOps.LinkByName(name)
+	if err != nil {
+		return "", nil, err
+	}
+	kind := parent.Type()
+	if kind != "bond" && kind != "team" {
+		return kind, nil, nil
+	}
+	links, err := linkOps.LinkList()
+	if err != nil {
+		return kind, nil, err
+	}
+	slaves := make(map[string]string)
+	for _, l := range links {
+		if l.Attrs().MasterIndex == parent.Attrs().Index {
+			slaves[l.Attrs().Name] = slaveState(l.Attrs().Name)
+		}
+	}
+	return kind, slaves, nil
+}
+
+// slaveState reads the bond mii status of a slave, or the operstate of team ports
+func slaveState(name string) string {
+	for _, f := range []string{"bonding_slave/mii_status", "operstate"} {
+		b, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/%s", name, f))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(b)) == slaveUp {
+			return slaveUp
+		}
+		return slaveDown
+	}
+	return slaveDown
+}
+
+// watchParents logs slave state changes of the bond and team parents so an
+// operator can see when a network is running on a single leg
+func (d *Driver) watchParents() {
+	updates := make(chan netlink.LinkUpdate)
+	if err := netlink.LinkSubscribe(updates, d.stop); err != nil {
+		log.Errorf("Unable to subscribe to link updates, parent slave changes won't be logged: %s", err)
+		return
+	}
+	states := make(map[string]string)
+	for u := range updates {
+		attrs := u.Link.Attrs()
+		if attrs.MasterIndex == 0 {
+			continue
+		}
+		state := slaveDown
+		if u.IfInfomsg.Flags&syscall.IFF_RUNNING != 0 {
+			state = slaveUp
+		}
+		prev, ok := states[attrs.Name]
+		if (ok && prev == state) || (!ok && state == slaveUp) {
+			states[attrs.Name] = state
+			continue
+		}
+		states[attrs.Name] = state
+		master, err := linkOps.LinkByIndex(attrs.MasterIndex)
+		if err != nil || len(d.parentNetworks(master.Attrs().Name)) == 0 {
+			continue
+		}
+		health := d.parentHealth(master.Attrs().Name)
+		if health.Degraded {
+			log.Warnf("Slave [ %s ] of parent [ %s ] is %s, networks [ %s ] are running on %d of %d slaves",
+				attrs.Name, health.Name, state, strings.Join(health.Networks, ","), health.slavesUp(), len(health.Slaves))
+		} else {
+			log.Infof("Slave [ %s ] of parent [ %s ] is %s", attrs.Name, health.Name, state)
+		}
+	}
+}
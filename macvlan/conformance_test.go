@@ -0,0 +1,321 @@
+package macvlan
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	sdk "github.com/docker/go-plugins-helpers/network"
+)
+
+// conformanceStep is a request as dockerd sends it and the checks of the
+// reply. Bodies use {{network}}, {{endpoint}} and {{iface}} placeholders.
+type conformanceStep struct {
+	name   string
+	path   string
+	body   string
+	status int
+	check  func(body []byte) error
+	// unknown steps use IDs the plugin was never told about
+	unknown bool
+}
+
+// recorded from the libnetwork remote driver of dockerd, a network create,
+// container run and container rm, then the same calls on unknown IDs
+var conformanceSteps = []conformanceStep{
+	{
+		name:   "activate",
+		path:   "/Plugin.Activate",
+		body:   `{}`,
+		status: http.StatusOK,
+		check:  checkActivate,
+	},
+	{
+		name:   "capabilities",
+		path:   "/NetworkDriver.GetCapabilities",
+		body:   `{}`,
+		status: http.StatusOK,
+		check:  checkCapabilities,
+	},
+	{
+		name:   "create network",
+		path:   "/NetworkDriver.CreateNetwork",
+		body:   `{"NetworkID":"{{network}}","Options":{"com.docker.network.enable_ipv6":false,"com.docker.network.generic":{"host_iface":"{{iface}}"}},"IPv4Data":[{"AddressSpace":"LocalDefault","Pool":"10.223.0.0/16","Gateway":"10.223.0.1/16","AuxAddresses":null}],"IPv6Data":[]}`,
+		status: http.StatusOK,
+		check:  checkEmpty,
+	},
+	{
+		name:   "create endpoint",
+		path:   "/NetworkDriver.CreateEndpoint",
+		body:   `{"NetworkID":"{{network}}","EndpointID":"{{endpoint}}","Interface":{"Address":"10.223.0.2/16","AddressIPv6":"","MacAddress":""},"Options":{"com.docker.network.endpoint.exposedports":[],"com.docker.network.portmap":[]}}`,
+		status: http.StatusOK,
+		check:  checkCreateEndpoint,
+	},
+	{
+		name:   "endpoint info",
+		path:   "/NetworkDriver.EndpointOperInfo",
+		body:   `{"NetworkID":"{{network}}","EndpointID":"{{endpoint}}"}`,
+		status: http.StatusOK,
+		check:  checkEndpointInfo,
+	},
+	{
+		name:   "join",
+		path:   "/NetworkDriver.Join",
+		body:   `{"NetworkID":"{{network}}","EndpointID":"{{endpoint}}","SandboxKey":"/var/run/docker/netns/conformance","Options":{"com.docker.network.endpoint.exposedports":[],"com.docker.network.portmap":[]}}`,
+		status: http.StatusOK,
+		check:  checkJoin,
+	},
+	{
+		name:   "leave",
+		path:   "/NetworkDriver.Leave",
+		body:   `{"NetworkID":"{{network}}","EndpointID":"{{endpoint}}"}`,
+		status: http.StatusOK,
+		check:  checkEmpty,
+	},
+	{
+		name:   "delete endpoint",
+		path:   "/NetworkDriver.DeleteEndpoint",
+		body:   `{"NetworkID":"{{network}}","EndpointID":"{{endpoint}}"}`,
+		status: http.StatusOK,
+		check:  checkEmpty,
+	},
+	{
+		name:   "delete network",
+		path:   "/NetworkDriver.DeleteNetwork",
+		body:   `{"NetworkID":"{{network}}"}`,
+		status: http.StatusOK,
+		check:  checkEmpty,
+	},
+	{
+		name:    "create endpoint on an unknown network",
+		path:    "/NetworkDriver.CreateEndpoint",
+		body:    `{"NetworkID":"{{network}}","EndpointID":"{{endpoint}}","Interface":{"Address":"10.223.0.2/16","AddressIPv6":"","MacAddress":""},"Options":{}}`,
+		status:  http.StatusInternalServerError,
+		check:   checkErr,
+		unknown: true,
+	},
+	{
+		name:    "join an unknown network",
+		path:    "/NetworkDriver.Join",
+		body:    `{"NetworkID":"{{network}}","EndpointID":"{{endpoint}}","SandboxKey":"/var/run/docker/netns/conformance","Options":{}}`,
+		status:  http.StatusInternalServerError,
+		check:   checkErr,
+		unknown: true,
+	},
+	{
+		name:    "endpoint info on an unknown network",
+		path:    "/NetworkDriver.EndpointOperInfo",
+		body:    `{"NetworkID":"{{network}}","EndpointID":"{{endpoint}}"}`,
+		status:  http.StatusOK,
+		check:   checkEndpointInfo,
+		unknown: true,
+	},
+	// deletes are retried by libnetwork and have to succeed on unknown IDs
+	{
+		name:    "leave an unknown network",
+		path:    "/NetworkDriver.Leave",
+		body:    `{"NetworkID":"{{network}}","EndpointID":"{{endpoint}}"}`,
+		status:  http.StatusOK,
+		check:   checkEmpty,
+		unknown: true,
+	},
+	{
+		name:    "delete an unknown endpoint",
+		path:    "/NetworkDriver.DeleteEndpoint",
+		body:    `{"NetworkID":"{{network}}","EndpointID":"{{endpoint}}"}`,
+		status:  http.StatusOK,
+		check:   checkEmpty,
+		unknown: true,
+	},
+	{
+		name:    "delete an unknown network",
+		path:    "/NetworkDriver.DeleteNetwork",
+		body:    `{"NetworkID":"{{network}}"}`,
+		status:  http.StatusOK,
+		check:   checkEmpty,
+		unknown: true,
+	},
+	{
+		name:   "malformed request",
+		path:   "/NetworkDriver.CreateNetwork",
+		body:   `{"NetworkID":`,
+		status: http.StatusBadRequest,
+	},
+}
+
+// TestConformance replays the recorded requests against the plugin API
+// served by network.NewHandler on a unix socket, the way dockerd calls it.
+// Each response has to have the status dockerd expects and parse the way
+// dockerd parses it.
+func TestConformance(t *testing.T) {
+	_, restore := useFakeLinks("fake0")
+	defer restore()
+	d, stop := testDriver(t)
+	defer stop()
+	dir, err := ioutil.TempDir("", "macvlan-conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "macvlan.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go sdk.NewHandler(d).Serve(l)
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	}}
+
+	known := strings.NewReplacer("{{network}}", testNetworkID("c", 0), "{{endpoint}}", testNetworkID("c", 1), "{{iface}}", "fake0")
+	unknown := strings.NewReplacer("{{network}}", testNetworkID("u", 0), "{{endpoint}}", testNetworkID("u", 1), "{{iface}}", "fake0")
+	for _, step := range conformanceSteps {
+		replacer := known
+		if step.unknown {
+			replacer = unknown
+		}
+		resp, err := client.Post("http://plugin"+step.path, "application/vnd.docker.plugins.v1.2+json", bytes.NewReader([]byte(replacer.Replace(step.body))))
+		if err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil && resp.StatusCode != step.status {
+			err = fmt.Errorf("status [ %d ], expected [ %d ]: %s", resp.StatusCode, step.status, strings.TrimSpace(string(body)))
+		}
+		if err == nil && step.check != nil {
+			err = step.check(body)
+		}
+		if err != nil {
+			t.Errorf("%s %s: %s", step.name, step.path, err)
+		}
+	}
+}
+
+// decodeStrict decodes a response rejecting fields dockerd doesn't know
+func decodeStrict(body []byte, res interface{}) error {
+	dec := json.NewDecoder(strings.NewReader(string(body)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(res); err != nil {
+		return fmt.Errorf("invalid response [ %s ]: %s", strings.TrimSpace(string(body)), err)
+	}
+	return nil
+}
+
+func checkActivate(body []byte) error {
+	res := &struct{ Implements []string }{}
+	if err := decodeStrict(body, res); err != nil {
+		return err
+	}
+	for _, i := range res.Implements {
+		if i == "NetworkDriver" {
+			return nil
+		}
+	}
+	return fmt.Errorf("Implements %v is missing NetworkDriver", res.Implements)
+}
+
+func checkCapabilities(body []byte) error {
+	res := &sdk.CapabilitiesResponse{}
+	if err := decodeStrict(body, res); err != nil {
+		return err
+	}
+	if res.Scope != sdk.LocalScope && res.Scope != sdk.GlobalScope {
+		return fmt.Errorf("invalid Scope [ %s ]", res.Scope)
+	}
+	return nil
+}
+
+// checkEmpty verifies a successful call returned an empty object
+func checkEmpty(body []byte) error {
+	res := map[string]interface{}{}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return fmt.Errorf("invalid response [ %s ]: %s", strings.TrimSpace(string(body)), err)
+	}
+	if len(res) != 0 {
+		return fmt.Errorf("expected an empty object, got [ %s ]", strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// checkErr verifies a failed call set the Err field dockerd reports
+func checkErr(body []byte) error {
+	res := &sdk.ErrorResponse{}
+	if err := decodeStrict(body, res); err != nil {
+		return err
+	}
+	if res.Err == "" {
+		return fmt.Errorf("empty Err")
+	}
+	return nil
+}
+
+// checkCreateEndpoint verifies the driver didn't return the address dockerd
+// allocated, libnetwork rejects changes to it
+func checkCreateEndpoint(body []byte) error {
+	res := &sdk.CreateEndpointResponse{}
+	if err := decodeStrict(body, res); err != nil {
+		return err
+	}
+	if res.Interface == nil {
+		return nil
+	}
+	if res.Interface.Address != "" {
+		return fmt.Errorf("Interface.Address [ %s ] was set by dockerd", res.Interface.Address)
+	}
+	if res.Interface.MacAddress != "" {
+		if _, err := net.ParseMAC(res.Interface.MacAddress); err != nil {
+			return fmt.Errorf("invalid Interface.MacAddress [ %s ]", res.Interface.MacAddress)
+		}
+	}
+	return nil
+}
+
+func checkEndpointInfo(body []byte) error {
+	res := &sdk.InfoResponse{}
+	if err := decodeStrict(body, res); err != nil {
+		return err
+	}
+	if res.Value == nil {
+		return fmt.Errorf("missing Value")
+	}
+	return nil
+}
+
+// checkJoin verifies the join reply parses the way the dockerd remote driver parses it
+func checkJoin(body []byte) error {
+	res := &sdk.JoinResponse{}
+	if err := decodeStrict(body, res); err != nil {
+		return err
+	}
+	if res.InterfaceName.SrcName == "" || res.InterfaceName.DstPrefix == "" {
+		return fmt.Errorf("InterfaceName needs SrcName and DstPrefix, got %+v", res.InterfaceName)
+	}
+	for name, gw := range map[string]string{"Gateway": res.Gateway, "GatewayIPv6": res.GatewayIPv6} {
+		if gw != "" && net.ParseIP(gw) == nil {
+			return fmt.Errorf("%s [ %s ] isn't an address", name, gw)
+		}
+	}
+	for _, r := range res.StaticRoutes {
+		if _, _, err := net.ParseCIDR(r.Destination); err != nil {
+			return fmt.Errorf("invalid StaticRoutes Destination [ %s ]", r.Destination)
+		}
+		if r.RouteType != 0 && r.RouteType != 1 {
+			return fmt.Errorf("invalid StaticRoutes RouteType [ %d ]", r.RouteType)
+		}
+		if r.RouteType == 0 && net.ParseIP(r.NextHop) == nil {
+			return fmt.Errorf("StaticRoutes NextHop [ %s ] isn't an address", r.NextHop)
+		}
+	}
+	return nil
+}
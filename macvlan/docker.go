@@ -1,7 +1,105 @@
 package macvlan
 
-import "github.com/samalba/dockerclient"
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/samalba/dockerclient"
+)
+
+// eventsAPIVersion is the first API version that streams network events and
+// returns container network settings. dockerclient pins the older v1.15.
+const eventsAPIVersion = "v1.22"
 
 type dockerer struct {
 	client *dockerclient.DockerClient
 }
+
+// eventStream is an open docker event subscription
+type eventStream struct {
+	body    io.ReadCloser
+	decoder *json.Decoder
+}
+
+// Next blocks until the next event is received or the stream is closed
+func (s *eventStream) Next() (*dockerclient.Event, error) {
+	e := &dockerclient.Event{}
+	if err := s.decoder.Decode(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Close the event subscription, unblocking any pending Next
+func (s *eventStream) Close() error {
+	return s.body.Close()
+}
+
+// monitorEvents subscribes to container and network events
+func (d dockerer) monitorEvents() (*eventStream, error) {
+	filters, err := json.Marshal(map[string][]string{
+		"type": {"container", "network"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	v := url.Values{}
+	v.Set("filters", string(filters))
+	res, err := d.get("/events?" + v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return &eventStream{body: res.Body, decoder: json.NewDecoder(res.Body)}, nil
+}
+
+// listContainers returns every container, running or not, with its network settings
+func (d dockerer) listContainers() ([]dockerclient.Container, error) {
+	res, err := d.get("/containers/json?all=1")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	containers := []dockerclient.Container{}
+	if err := json.NewDecoder(res.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+func (d dockerer) get(path string) (*http.Response, error) {
+	res, err := d.client.HTTPClient.Get(fmt.Sprintf("%s/%s%s", d.client.URL.String(), eventsAPIVersion, path))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("docker API request [ %s ] failed: %s", path, res.Status)
+	}
+	return res, nil
+}
+
+// ping checks the docker API is reachable
+func (d dockerer) ping() error {
+	res, err := d.get("/_ping")
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// inspectContainer returns the container details including its network endpoints
+func (d dockerer) inspectContainer(id string) (*dockerclient.ContainerInfo, error) {
+	res, err := d.get("/containers/" + id + "/json")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	info := &dockerclient.ContainerInfo{}
+	if err := json.NewDecoder(res.Body).Decode(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -3,7 +3,9 @@ package macvlan
 import (
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
@@ -19,18 +21,42 @@ const (
 	minMTU               = 68
 )
 
+// DefaultDockerHost is the docker API endpoint used when --docker-host isn't set
+const DefaultDockerHost = "unix:///var/run/docker.sock"
+
 // Driver is the MACVLAN Driver
 type Driver struct {
 	sdk.Driver
 	dockerer
 	networks   networkTable
 	nameserver string
+	calls      sync.WaitGroup
+	stopping   bool
+	stop       chan struct{}
+	// scope is local unless a store coordinates the hosts in global scope
+	scope string
+	store Store
+	// node names this host in store reservations
+	node string
+	// netLocks serializes the calls on a network and linkLocks the changes
+	// to a host parent, shim, VRF or routing table
+	netLocks  keyedLocks
+	linkLocks keyedLocks
+	// netChecks serializes the loading of the existing libnetwork networks
+	netChecks sync.Mutex
+	// resyncs serializes the resyncs, resynced is when the last completed one started
+	resyncs  sync.Mutex
+	resynced time.Time
 	sync.Mutex
 }
 
 // NewDriver creates a new MACVLAN Driver
 func NewDriver(version string, ctx *cli.Context) (*Driver, error) {
-	docker, err := dockerclient.NewDockerClient("unix:///var/run/docker.sock", nil)
+	dockerHost := ctx.String("docker-host")
+	if dockerHost == "" {
+		dockerHost = DefaultDockerHost
+	}
+	docker, err := dockerclient.NewDockerClient(dockerHost, nil)
 	if err != nil {
 		return nil, fmt.Errorf("could not connect to docker: %s", err)
 	}
@@ -53,151 +79,500 @@ func NewDriver(version string, ctx *cli.Context) (*Driver, error) {
 	}
 	d := &Driver{
 		networks: networkTable{},
+		stop:     make(chan struct{}),
 		dockerer: dockerer{
 			client: docker,
 		},
 	}
+	if err := d.setupScope(ctx.String("scope"), ctx.String("store")); err != nil {
+		return nil, err
+	}
+	if path := ctx.String("audit-log"); path != "" {
+		audit, err := openAuditLog(path)
+		if err != nil {
+			return nil, err
+		}
+		hostAudit = audit
+	}
+	go d.watchEvents()
+	go d.watchResync()
+	go d.watchParents()
 	return d, nil
 }
 
-// GetCapabilities tells libnetwork this driver is local scope
+// GetCapabilities tells libnetwork the driver scope, global when a store coordinates the hosts
 func (d *Driver) GetCapabilities() (*sdk.CapabilitiesResponse, error) {
-	scope := &sdk.CapabilitiesResponse{Scope: sdk.LocalScope}
+	scope := &sdk.CapabilitiesResponse{Scope: d.scope}
 	return scope, nil
 }
 
 // CreateNetwork creates a new MACVLAN network
-func (d *Driver) CreateNetwork(r *sdk.CreateNetworkRequest) error {
-	var netCidr *net.IPNet
+func (d *Driver) CreateNetwork(r *sdk.CreateNetworkRequest) (err error) {
+	l := newCallLog("CreateNetwork", r.NetworkID, "", "")
+	defer l.end(&err)
+	if err := d.startCall(); err != nil {
+		return err
+	}
+	defer d.calls.Done()
+	defer d.netLocks.lock(r.NetworkID)()
+	var netCidr, netCidr6 *net.IPNet
 	var netGw string
-	var err error
-	log.Debugf("Network Create Called: [ %+v ]", r)
+	l.Debugf("Network Create Called: [ %+v ]", r)
 	for _, v4 := range r.IPv4Data {
+		// dockerd sends the gateway with the pool prefix length, Join has to return the address
 		netGw = v4.Gateway
+		if gw, _, err := net.ParseCIDR(v4.Gateway); err == nil {
+			netGw = gw.String()
+		}
 		_, netCidr, err = net.ParseCIDR(v4.Pool)
 		if err != nil {
 			return err
 		}
 	}
+	for _, v6 := range r.IPv6Data {
+		_, netCidr6, err = net.ParseCIDR(v6.Pool)
+		if err != nil {
+			return err
+		}
+	}
 
 	n := &network{
 		id:        r.NetworkID,
 		endpoints: endpointTable{},
 		cidr:      netCidr,
+		cidr6:     netCidr6,
 		gateway:   netGw,
 	}
 
 	// Parse docker network -o opts
-	for k, v := range r.Options {
-		if k == "com.docker.sdk.generic" {
-			if genericOpts, ok := v.(map[string]interface{}); ok {
-				for key, val := range genericOpts {
-					log.Debugf("Libnetwork Opts Sent: [ %s ] Value: [ %s ]", key, val)
-					// Parse -o host_iface from libnetwork generic opts
-					if key == "host_iface" {
-						n.ifaceOpt = val.(string)
-					}
-				}
-			}
+	opts := parseOptions(r.Options)
+	if err := n.setOptions(opts); err != nil {
+		return err
+	}
+	defer d.linkLocks.lock(n.hostKeys()...)()
+	if err := d.checkRouteTable(n); err != nil {
+		return err
+	}
+	if err := n.setupHost(l); err != nil {
+		return err
+	}
+	if d.store != nil {
+		if err := d.saveNetwork(n, opts); err != nil {
+			d.teardownHost(l, n)
+			return err
 		}
 	}
 	d.addNetwork(n)
 	return nil
 }
 
+// setOptions applies the docker network -o opts to the network
+func (n *network) setOptions(opts map[string]string) error {
+	for key, val := range opts {
+		log.Debugf("Libnetwork Opts Sent: [ %s ] Value: [ %s ]", key, val)
+	}
+	// Parse -o host_iface from libnetwork generic opts
+	n.ifaceOpt = opts[optHostIface]
+	n.modeOpt = macvlanMode
+	if mode, ok := opts[optMode]; ok {
+		if _, err := setVlanMode(mode); err != nil {
+			return fmt.Errorf("invalid -o %s: %s", optMode, err)
+		}
+		n.modeOpt = mode
+	}
+	linkType, err := parseLinkType(opts)
+	if err != nil {
+		return err
+	}
+	n.linkType = linkType
+	if n.bondSlaves, n.bondMode, err = parseBond(opts); err != nil {
+		return err
+	}
+	if len(n.bondSlaves) > 0 && n.ifaceOpt == "" {
+		return fmt.Errorf("-o %s requires -o %s to name the bond", optBondSlaves, optHostIface)
+	}
+	if n.routeTable, err = parseRouteTable(opts); err != nil {
+		return err
+	}
+	n.shimIface = opts[optShimIface]
+	n.vrf = opts[optVrf]
+	if n.vrf != "" && n.ifaceOpt == "" && opts[optVxlanID] == "" {
+		return fmt.Errorf("-o %s requires -o %s to name the parent", optVrf, optHostIface)
+	}
+	if n.vxlan, err = parseVxlan(opts); err != nil {
+		return err
+	}
+	if n.vxlan != nil {
+		if len(n.bondSlaves) > 0 {
+			return fmt.Errorf("-o %s and -o %s are mutually exclusive", optVxlanID, optBondSlaves)
+		}
+		if n.ifaceOpt == "" {
+			n.ifaceOpt = n.vxlan.defaultName()
+		}
+	}
+	egress, err := parseBandwidth(opts, nil)
+	if err != nil {
+		return err
+	}
+	n.egress = egress
+	if n.noGateway, err = parseBoolOption(opts, optNoGateway); err != nil {
+		return err
+	}
+	if n.keepDockerGateway, err = parseBoolOption(opts, optKeepDockerGateway); err != nil {
+		return err
+	}
+	if n.antiSpoof, err = parseBoolOption(opts, optAntiSpoof); err != nil {
+		return err
+	}
+	if n.sysctls, err = parseSysctls(opts, nil); err != nil {
+		return err
+	}
+	if n.poolSize, err = parseLinkPool(opts); err != nil {
+		return err
+	}
+	if n.noGateway && n.keepDockerGateway {
+		return fmt.Errorf("-o %s and -o %s are mutually exclusive", optNoGateway, optKeepDockerGateway)
+	}
+	if routes, ok := opts[optRoutes]; ok {
+		if n.routes, err = parseStaticRoutes(routes, n.cidr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joinGateway returns the default gateway handed to containers and whether
+// docker's gateway bridge is left out. The bridge is only attached when the
+// network keeps the docker gateway instead of its own.
+func (n *network) joinGateway() (string, bool) {
+	if n.noGateway || n.keepDockerGateway {
+		return "", !n.keepDockerGateway
+	}
+	return n.gateway, true
+}
+
+// hostKeys are the host links and routing table a network changes, locked
+// while they are set up or deleted
+func (n *network) hostKeys() []string {
+	keys := []string{n.ifaceOpt, n.shimIface, n.vrf}
+	if n.routeTable != 0 {
+		keys = append(keys, fmt.Sprintf("%s=%d", optRouteTable, n.routeTable))
+	}
+	return keys
+}
+
+// setupHost creates the host side of a network, its parent, VRF and policy
+// routing. When a step fails the changes of the steps before it are undone
+// in reverse, host state that was already there is left as it was.
+func (n *network) setupHost(l *callLog) (err error) {
+	var undo []func()
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}()
+	for _, step := range []func(*callLog) (func(), error){n.setupParent, n.setupVrf, n.setupPolicyRouting} {
+		stepUndo, err := step(l)
+		if stepUndo != nil {
+			undo = append(undo, stepUndo)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := n.checkVrfGateway(); err != nil {
+		return err
+	}
+	return n.startPool(l)
+}
+
+// setupParent creates the bond or vxlan parent requested by the network
+// options. undo deletes the parent if the call created it.
+func (n *network) setupParent(l *callLog) (undo func(), err error) {
+	if len(n.bondSlaves) == 0 && n.vxlan == nil {
+		return nil, nil
+	}
+	if _, err := linkOps.LinkByName(n.ifaceOpt); err != nil {
+		undo = func() { n.deleteParent(l) }
+	}
+	switch {
+	case len(n.bondSlaves) > 0:
+		n.ownsParent, err = setupBond(l, n.ifaceOpt, n.bondSlaves, n.bondMode)
+	case n.vxlan != nil:
+		n.ownsParent, err = n.vxlan.setup(l, n.ifaceOpt)
+	}
+	return undo, err
+}
+
+// deleteParent deletes a parent created by the driver for the network
+func (n *network) deleteParent(l *callLog) {
+	if !n.ownsParent {
+		return
+	}
+	switch {
+	case len(n.bondSlaves) > 0:
+		deleteBond(l, n.ifaceOpt)
+	case n.vxlan != nil:
+		deleteVxlan(l, n.ifaceOpt)
+	}
+}
+
 // DeleteNetwork deletes a network
-func (d *Driver) DeleteNetwork(r *sdk.DeleteNetworkRequest) error {
-	log.Debugf("Delete network request: %+v", &r)
-	d.deleteNetwork(r.NetworkID)
+func (d *Driver) DeleteNetwork(r *sdk.DeleteNetworkRequest) (err error) {
+	l := newCallLog("DeleteNetwork", r.NetworkID, "", "")
+	defer l.end(&err)
+	if err := d.startCall(); err != nil {
+		return err
+	}
+	defer d.calls.Done()
+	l.Debugf("Delete network request: %+v", r)
+	defer d.netLocks.lock(r.NetworkID)()
+	n, err := d.getNetwork(r.NetworkID)
+	if err != nil {
+		if d.store != nil {
+			d.removeNetwork(r.NetworkID)
+		}
+		return nil
+	}
+	d.teardownNetwork(l, n)
 	return nil
 }
 
+// teardownNetwork drops a network from the table and the store and removes
+// its host side. Callers hold the network lock.
+func (d *Driver) teardownNetwork(l *callLog, n *network) {
+	defer d.linkLocks.lock(n.hostKeys()...)()
+	d.deleteNetwork(n.id)
+	if d.store != nil {
+		d.removeNetwork(n.id)
+	}
+	d.teardownHost(l, n)
+}
+
+// teardownHost removes the host side of a network that is no longer in the
+// table, its pool links, policy routing, and the VRF and parent once no other
+// network uses them. Callers hold the network and host locks.
+func (d *Driver) teardownHost(l *callLog, n *network) {
+	n.stopPool(l, true)
+	n.deletePolicyRouting(l)
+	if n.vrf != "" && len(d.vrfNetworks(n.vrf)) == 0 {
+		n.deleteVrf(l)
+	}
+	// Parents created by the driver are removed with the last network using
+	// them, a vxlan parent that stays loses the remotes of the network
+	if len(d.parentNetworks(n.ifaceOpt)) == 0 && n.ownsParent {
+		n.deleteParent(l)
+	} else if n.vxlan != nil {
+		n.vxlan.deleteRemotes(l, n.ifaceOpt, d.vxlanRemotes(n.ifaceOpt))
+	}
+}
+
 // CreateEndpoint creates a new MACVLAN Endpoint
-func (d *Driver) CreateEndpoint(r *sdk.CreateEndpointRequest) (*sdk.CreateEndpointResponse, error) {
+func (d *Driver) CreateEndpoint(r *sdk.CreateEndpointRequest) (res *sdk.CreateEndpointResponse, err error) {
+	l := newCallLog("CreateEndpoint", r.NetworkID, r.EndpointID, "")
+	defer l.end(&err)
+	if err := d.startCall(); err != nil {
+		return nil, err
+	}
+	defer d.calls.Done()
+	defer d.netLocks.lock(r.NetworkID)()
 	endID := r.EndpointID
-	log.Debugf("The container subnet for this context is [ %s ]", r.Interface.Address)
-	// Request an IP address from libnetwork based on the cidr scope
-	// TODO: Add a user defined static ip addr option in Docker v1.10
-	containerAddress := r.Interface.Address
-	if containerAddress == "" {
+	iface := r.Interface
+	if iface == nil {
+		iface = &sdk.EndpointInterface{}
+	}
+	l.Debugf("The container subnet for this context is [ %s ]", iface.Address)
+	n, err := d.lookupNetwork(l, r.NetworkID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create endpoint [ %s ] on unknown network [ %s ]: %s", endID, r.NetworkID, err)
+	}
+	opts := parseOptions(r.Options)
+	ep := &endpoint{
+		id:      endID,
+		created: time.Now(),
+	}
+	// IP addrs comes from libnetwork ipam via user 'docker network' and 'docker run --ip' parameters.
+	// Only the mac the driver picks is returned, libnetwork rejects changes to the addresses it allocated.
+	res = &sdk.CreateEndpointResponse{Interface: &sdk.EndpointInterface{}}
+	if err := checkAddressOptions(opts); err != nil {
+		return nil, err
+	}
+	if ep.addr, err = endpointAddress(iface.Address, n.cidr); err != nil {
+		return nil, err
+	}
+	if ep.addr == nil {
 		return nil, fmt.Errorf("Unable to obtain an IP address from libnetwork default ipam")
 	}
-	// generate a mac address for the pending container
-	mac := makeMac(net.ParseIP(containerAddress))
-
-	log.Infof("Allocated container IP: [ %s ]", containerAddress)
-	// IP addrs comes from libnetwork ipam via user 'docker network' parameters
-
-	res := &sdk.CreateEndpointResponse{
-		Interface: &sdk.EndpointInterface{
-			Address:    containerAddress,
-			MacAddress: mac,
-		},
+	if ep.addrv6, err = endpointAddress(iface.AddressIPv6, n.cidr6); err != nil {
+		return nil, err
+	}
+	l.Infof("Allocated container IP: [ %s ]", ep.addr)
+	// Use the docker run --mac-address or generate a mac address for the pending container
+	if ep.mac, err = endpointMac(iface.MacAddress, opts); err != nil {
+		return nil, err
 	}
-	log.Debugf("Create endpoint response: %+v", res)
-	log.Debugf("Create endpoint %s %+v", endID, res)
+	if ep.mac == nil {
+		ep.mac, _ = net.ParseMAC(makeMac(ep.addr.IP))
+	}
+	if iface.MacAddress == "" {
+		res.Interface.MacAddress = ep.mac.String()
+	}
+	// Endpoint options override the network egress limits
+	if ep.egress, err = parseBandwidth(opts, n.egress); err != nil {
+		return nil, err
+	}
+	ep.antiSpoof = n.antiSpoof
+	if _, ok := opts[optAntiSpoof]; ok {
+		if ep.antiSpoof, err = parseBoolOption(opts, optAntiSpoof); err != nil {
+			return nil, err
+		}
+	}
+	if ep.sysctls, err = parseSysctls(opts, n.sysctls); err != nil {
+		return nil, err
+	}
+	// conflicts are checked against every network on the parent
+	defer d.linkLocks.lock(n.ifaceOpt)()
+	if err := d.checkEndpointConflicts(n, ep); err != nil {
+		return nil, err
+	}
+	if d.store != nil {
+		if err := d.reserveEndpoint(n.id, ep); err != nil {
+			return nil, err
+		}
+	}
+	n.addEndpoint(ep)
+	l.Debugf("Create endpoint response: %+v", res)
 	return res, nil
 }
 
 // DeleteEndpoint deletes a MACVLAN Endpoint
-func (d *Driver) DeleteEndpoint(r *sdk.DeleteEndpointRequest) error {
-	log.Debugf("Delete endpoint request: %+v", &r)
+func (d *Driver) DeleteEndpoint(r *sdk.DeleteEndpointRequest) (err error) {
+	l := newCallLog("DeleteEndpoint", r.NetworkID, r.EndpointID, d.endpointSandbox(r.NetworkID, r.EndpointID))
+	defer l.end(&err)
+	if err := d.startCall(); err != nil {
+		return err
+	}
+	defer d.calls.Done()
+	l.Debugf("Delete endpoint request: %+v", r)
 	//TODO: null check cidr in case driver restarted and doesn't know the network to avoid panic
-	log.Debugf("Delete endpoint %s", r.EndpointID)
+	defer d.netLocks.lock(r.NetworkID)()
 
-	containerLink := r.EndpointID[:5]
-	// Check the interface to delete exists to avoid a netlink panic
-	if ok := validateHostIface(containerLink); !ok {
-		return fmt.Errorf("The requested interface to delete [ %s ] was not found on the host.", containerLink)
+	if n, err := d.getNetwork(r.NetworkID); err == nil {
+		if ep := n.endpoint(r.EndpointID); ep != nil {
+			// Leave isn't sent for the endpoints of a plugin that was restarted
+			if err := d.deleteParentAntiSpoof(l, n, ep); err != nil {
+				l.Errorf("%s", err)
+			}
+			if d.store != nil {
+				d.releaseEndpointKeys(n.id, ep)
+			}
+		}
+		n.deleteEndpoint(r.EndpointID)
+	}
+	// The link is normally destroyed along with the container netns. It is only
+	// still on the host if the endpoint was never moved or the events watcher
+	// has not already cleaned it up.
+	containerLink := hostLinkName(r.EndpointID)
+	if deleteHostLink(l, containerLink) {
+		l.Infof("Deleted the unused macvlan link [ %s ] from the removed container", containerLink)
 	}
-	// Get the link handle
-	link, err := netlink.LinkByName(containerLink)
+	return nil
+}
+
+// lookupNetwork returns a network, loading the existing libnetwork networks
+// if it isn't known yet. Callers hold the network lock.
+func (d *Driver) lookupNetwork(l *callLog, nid string) (*network, error) {
+	n, err := d.getNetwork(nid)
 	if err != nil {
-		return fmt.Errorf("Error looking up link [ %s ] object: [ %v ] error: [ %s ]", link.Attrs().Name, link, err)
+		// Init any existing libnetwork networks
+		d.existingNetChecks(l)
+		n, err = d.getNetwork(nid)
 	}
-	log.Infof("Deleting the unused macvlan link [ %s ] from the removed container", link.Attrs().Name)
-	if err := netlink.LinkDel(link); err != nil {
-		log.Errorf("unable to delete the Macvlan link [ %s ] on leave: %s", link.Attrs().Name, err)
+	if err != nil && d.store != nil {
+		// global scope networks may have been created on another host
+		if stored, loadErr := d.loadNetwork(l, nid); loadErr == nil {
+			d.addNetwork(stored)
+			return stored, nil
+		}
 	}
-	return nil
+	return n, err
 }
 
 // EndpointInfo returns informatoin about a MACVLAN endpoint
-func (d *Driver) EndpointInfo(r *sdk.InfoRequest) (*sdk.InfoResponse, error) {
-	log.Debugf("Endpoint info request: %+v", &r)
-	res := &sdk.InfoResponse{
+func (d *Driver) EndpointInfo(r *sdk.InfoRequest) (res *sdk.InfoResponse, err error) {
+	l := newCallLog("EndpointInfo", r.NetworkID, r.EndpointID, "")
+	defer l.end(&err)
+	l.Debugf("Endpoint info request: %+v", r)
+	res = &sdk.InfoResponse{
 		Value: make(map[string]string),
 	}
+	if n, err := d.getNetwork(r.NetworkID); err == nil {
+		if ep := n.endpoint(r.EndpointID); ep != nil {
+			if ep.egress != nil {
+				for k, v := range ep.egress.info() {
+					res.Value[k] = v
+				}
+			}
+			if tap := n.tapDevice(ep.id); tap != nil {
+				for k, v := range tap.info() {
+					res.Value[k] = v
+				}
+			}
+			if n.ifaceOpt != "" {
+				for k, v := range d.parentHealth(n.ifaceOpt).info() {
+					res.Value[k] = v
+				}
+			}
+			if ep.antiSpoof {
+				for k, v := range ep.antiSpoofInfo(n.ifaceOpt, n.sandbox(ep.id)) {
+					res.Value[k] = v
+				}
+			}
+			for k, v := range sysctlInfo(ep.sysctls) {
+				res.Value[k] = v
+			}
+		}
+	}
 	return res, nil
 }
 
 // Join creates a MACVLAN interface to be moved to the container netns
-func (d *Driver) Join(r *sdk.JoinRequest) (*sdk.JoinResponse, error) {
-	log.Debugf("Join request: %+v", &r)
-	getID, err := d.getNetwork(r.NetworkID)
+func (d *Driver) Join(r *sdk.JoinRequest) (res *sdk.JoinResponse, err error) {
+	l := newCallLog("Join", r.NetworkID, r.EndpointID, r.SandboxKey)
+	defer l.end(&err)
+	if err := d.startCall(); err != nil {
+		return nil, err
+	}
+	defer d.calls.Done()
+	l.Debugf("Join request: %+v", r)
+	defer d.netLocks.lock(r.NetworkID)()
+	getID, err := d.lookupNetwork(l, r.NetworkID)
 	if err != nil {
-		// Init any existing libnetwork networks
-		d.existingNetChecks()
-
-		getID, err = d.getNetwork(r.NetworkID)
-		if err != nil {
-			return nil, fmt.Errorf("error getting network ID [ %s ]. Run 'docker network ls' or 'docker network create' Err: %v", r.NetworkID, err)
-		}
+		return nil, fmt.Errorf("error getting network ID [ %s ]. Run 'docker network ls' or 'docker network create' Err: %v", r.NetworkID, err)
 	}
 	endID := r.EndpointID
 	// unique name while still on the common netns
-	preMoveName := endID[:5]
-	mode, err := setVlanMode("bridge")
+	preMoveName := hostLinkName(endID)
+	mode, err := setVlanMode(getID.modeOpt)
 	if err != nil {
 		return nil, fmt.Errorf("error getting vlan mode [ %v ]: %s", mode, err)
 	}
 	if getID.ifaceOpt == "" {
 		return nil, fmt.Errorf("Required macvlan parent interface is missing, please recreate the network specifying the -o host_iface=ethX")
 	}
+	defer d.linkLocks.lock(getID.ifaceOpt)()
+	// libnetwork moves the link back to the host netns under its original
+	// name when the endpoint leaves a sandbox, a rejoin starts from a new link
+	if _, err := linkOps.LinkByName(preMoveName); err == nil {
+		deleteHostLink(l, preMoveName)
+	}
 	// Get the link for the master index (Example: the docker host eth iface)
-	hostEth, err := netlink.LinkByName(getID.ifaceOpt)
+	hostEth, err := linkOps.LinkByName(getID.ifaceOpt)
 	if err != nil {
-		log.Warnf("Error looking up the parent iface [ %s ] error: [ %s ]", getID.ifaceOpt, err)
+		l.Warnf("Error looking up the parent iface [ %s ] error: [ %s ]", getID.ifaceOpt, err)
 	}
 	mvlan := &netlink.Macvlan{
 		LinkAttrs: netlink.LinkAttrs{
@@ -206,20 +581,97 @@ func (d *Driver) Join(r *sdk.JoinRequest) (*sdk.JoinResponse, error) {
 		},
 		Mode: mode,
 	}
-	if err := netlink.LinkAdd(mvlan); err != nil {
-		log.Warnf("Failed to create the netlink link: [ %v ] with the "+
+	var link netlink.Link = mvlan
+	// A link claimed from the -o link_pool already has the MTU set
+	var pooled netlink.Link
+	if pool := getID.linkPool(); pool != nil {
+		defer pool.requestRefill()
+		var mac net.HardwareAddr
+		if ep := getID.endpoint(endID); ep != nil {
+			mac = ep.mac
+		}
+		pooled = pool.claim(l, preMoveName, mac)
+	}
+	switch {
+	case pooled != nil:
+		link = pooled
+	case getID.linkType == linkTypeMacvtap:
+		link = &netlink.Macvtap{Macvlan: *mvlan}
+		fallthrough
+	default:
+		err = l.audit(auditLinkAdd, preMoveName, linkDetail(getID), linkOps.LinkAdd(link))
+	}
+	if err != nil {
+		l.Warnf("Failed to create the netlink link: [ %v ] with the "+
 			"error: %s Note: a parent index cannot be link to both macvlan "+
 			"and macvlan simultaneously. A new parent index is required", mvlan, err)
-		log.Warnf("Also check `/var/run/docker/netns/` for orphaned links to unmount and delete, then restart the plugin")
-		log.Warnf("Run this to clean orphaned links 'umount /var/run/docker/netns/* && rm /var/run/docker/netns/*'")
+		l.Warnf("Also check `/var/run/docker/netns/` for orphaned links to unmount and delete, then restart the plugin")
+		l.Warnf("Run this to clean orphaned links 'umount /var/run/docker/netns/* && rm /var/run/docker/netns/*'")
 	}
-	// Set the netlink iface MTU, default is 1500
-	if err := netlink.LinkSetMTU(mvlan, defaultMTU); err != nil {
-		log.Errorf("Error setting the MTU [ %d ] for link [ %s ]: %s", defaultMTU, mvlan.Name, err)
+	// Set the netlink iface MTU, default is 1500 unless the parent has a smaller one, and the endpoint mac
+	if pooled == nil {
+		if err := setLinkAlias(l, link, endpointLinkAlias(getID.id)); err != nil {
+			deleteHostLink(l, preMoveName)
+			return nil, err
+		}
+		mtu := linkMTU(hostEth)
+		if err := l.audit(auditLinkMTU, preMoveName, strconv.Itoa(mtu), linkOps.LinkSetMTU(link, mtu)); err != nil {
+			deleteHostLink(l, preMoveName)
+			return nil, fmt.Errorf("Error setting the MTU [ %d ] for link [ %s ]: %s", mtu, mvlan.Name, err)
+		}
+		if ep := getID.endpoint(endID); ep != nil && ep.mac != nil {
+			if err := l.audit(auditLinkMac, preMoveName, ep.mac.String(), linkOps.LinkSetHardwareAddr(link, ep.mac)); err != nil {
+				l.Errorf("Error setting the mac [ %s ] for link [ %s ]: %s", ep.mac, mvlan.Name, err)
+			}
+		}
 	}
 	// Bring the netlink iface up
-	if err := netlink.LinkSetUp(mvlan); err != nil {
-		log.Warnf("failed to enable the macvlan netlink link: [ %v ]", mvlan, err)
+	if err := l.audit(auditLinkUp, preMoveName, "", linkOps.LinkSetUp(link)); err != nil {
+		l.Warnf("failed to enable the macvlan netlink link: [ %v ]: %s", mvlan, err)
+	}
+	// the limit is applied in the sandbox. It is tried on the host link and
+	// removed again first so Join fails when the kernel rejects it.
+	if ep := getID.endpoint(endID); ep != nil && ep.egress != nil {
+		hostLink, err := linkOps.LinkByName(preMoveName)
+		if err == nil {
+			err = ep.egress.hook()(l, hostLink)
+		}
+		if err == nil {
+			err = ep.egress.teardown(l, hostLink)
+		}
+		if err != nil {
+			deleteHostLink(l, preMoveName)
+			return nil, err
+		}
+	}
+	// the parent filters are enforced before the container can send anything
+	if ep := getID.endpoint(endID); ep != nil && ep.antiSpoof && ep.mac != nil {
+		if err := ep.addParentAntiSpoof(l, hostEth); err != nil {
+			deleteHostLink(l, preMoveName)
+			return nil, err
+		}
+	}
+	// the guard passes the mac of an endpoint without anti spoofing joining
+	// a parent shared with endpoints that have it
+	if d.parentAntiSpoof(getID.ifaceOpt) {
+		if err := d.syncParentGuard(l, hostEth); err != nil {
+			if ep := getID.endpoint(endID); ep != nil && ep.antiSpoof && ep.mac != nil {
+				if delErr := ep.deleteParentAntiSpoof(l, hostEth); delErr != nil {
+					l.Errorf("%s", delErr)
+				}
+			}
+			deleteHostLink(l, preMoveName)
+			return nil, err
+		}
+	}
+	// The tap character device is only visible in the host sysfs before the move
+	if macvtap, ok := link.(*netlink.Macvtap); ok {
+		tap, err := macvtapDevice(macvtap)
+		if err != nil {
+			deleteHostLink(l, preMoveName)
+			return nil, err
+		}
+		getID.setTap(endID, tap)
 	}
 	// SrcName gets renamed to DstPrefix on the container iface
 	ifname := &sdk.InterfaceName{
@@ -227,35 +679,141 @@ func (d *Driver) Join(r *sdk.JoinRequest) (*sdk.JoinResponse, error) {
 		DstPrefix: containerIfacePrefix,
 	}
 
-	res := &sdk.JoinResponse{
-		InterfaceName:         *ifname,
-		Gateway:               getID.gateway,
-		DisableGatewayService: true,
+	res = &sdk.JoinResponse{
+		InterfaceName: *ifname,
+		StaticRoutes:  getID.routes,
 	}
-	log.Debugf("Join response: %+v", res)
-	log.Debugf("Join endpoint %s:%s to %s", r.NetworkID, r.EndpointID, r.SandboxKey)
+	res.Gateway, res.DisableGatewayService = getID.joinGateway()
+	// Settings that don't survive the netns move are applied once libnetwork
+	// has moved the link into the sandbox
+	if ep := getID.endpoint(endID); ep != nil {
+		getID.setSandbox(endID, r.SandboxKey)
+		if hooks := ep.sandboxHooks(); len(hooks) > 0 {
+			configured := make(chan struct{})
+			ep.configured = configured
+			d.calls.Add(1)
+			go func() {
+				defer d.calls.Done()
+				defer close(configured)
+				if err := configureSandbox(l, r.SandboxKey, mvlan.Name, ep.mac, hooks); err != nil {
+					l.Errorf("Unable to configure endpoint [ %s ] in sandbox [ %s ]: %s", endID, r.SandboxKey, err)
+				}
+			}()
+		}
+	}
+	l.Debugf("Join response: %+v", res)
 	return res, nil
 }
 
 // Leave removes a MACVLAN Endpoint from a container
-func (d *Driver) Leave(r *sdk.LeaveRequest) error {
-	log.Debugf("Leave request: %+v", &r)
-	log.Debugf("Leave %s:%s", r.NetworkID, r.EndpointID)
-	return nil
+func (d *Driver) Leave(r *sdk.LeaveRequest) (err error) {
+	l := newCallLog("Leave", r.NetworkID, r.EndpointID, d.endpointSandbox(r.NetworkID, r.EndpointID))
+	defer l.end(&err)
+	if err := d.startCall(); err != nil {
+		return err
+	}
+	defer d.calls.Done()
+	l.Debugf("Leave request: %+v", r)
+	defer d.netLocks.lock(r.NetworkID)()
+	// libnetwork retries Leave, there is nothing to undo for unknown endpoints
+	n, err := d.getNetwork(r.NetworkID)
+	if err != nil {
+		return nil
+	}
+	ep := n.endpoint(r.EndpointID)
+	if ep == nil {
+		return nil
+	}
+	if ep.configured != nil {
+		<-ep.configured
+		ep.configured = nil
+	}
+	// The link is still in the sandbox, libnetwork moves it out after Leave
+	sandboxKey := n.sandbox(ep.id)
+	if hooks := ep.sandboxTeardown(); sandboxKey != "" && len(hooks) > 0 {
+		if tdErr := deconfigureSandbox(l, sandboxKey, ep.mac, hooks); tdErr != nil {
+			err = fmt.Errorf("unable to deconfigure endpoint [ %s ] in sandbox [ %s ]: %s", ep.id, sandboxKey, tdErr)
+		}
+	}
+	if tdErr := d.deleteParentAntiSpoof(l, n, ep); tdErr != nil && err == nil {
+		err = tdErr
+	}
+	ep.savedSysctls = nil
+	n.setSandbox(ep.id, "")
+	n.setTap(ep.id, nil)
+	return err
 }
 
-// DiscoverNew is not used by local scoped drivers
-func (d *Driver) DiscoverNew(r *sdk.DiscoveryNotification) error {
-	return nil
+// deleteParentAntiSpoof removes the endpoint filters from the network parent
+func (d *Driver) deleteParentAntiSpoof(l *callLog, n *network, ep *endpoint) error {
+	if !ep.antiSpoof || ep.mac == nil {
+		return nil
+	}
+	defer d.linkLocks.lock(n.ifaceOpt)()
+	parent, err := linkOps.LinkByName(n.ifaceOpt)
+	if err != nil {
+		// the filters went with a deleted parent
+		return nil
+	}
+	if err := ep.deleteParentAntiSpoof(l, parent); err != nil {
+		return err
+	}
+	// the guard goes with the filters of the last endpoint
+	return d.syncParentGuard(l, parent)
+}
+
+// parentAntiSpoof reports whether an endpoint on the parent has anti spoofing
+func (d *Driver) parentAntiSpoof(parent string) bool {
+	for _, n := range d.getNetworks() {
+		if n.ifaceOpt != parent {
+			continue
+		}
+		for _, ep := range n.getEndpoints() {
+			if ep.antiSpoof && ep.mac != nil {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-// DiscoverDelete is not used by local scoped drivers
-func (d *Driver) DiscoverDelete(r *sdk.DiscoveryNotification) error {
+// DiscoverNew records the nodes libnetwork discovers in global scope
+func (d *Driver) DiscoverNew(r *sdk.DiscoveryNotification) (err error) {
+	l := newCallLog("DiscoverNew", "", "", "")
+	defer l.end(&err)
+	if err := d.startCall(); err != nil {
+		return err
+	}
+	defer d.calls.Done()
+	l.Debugf("Discover new request: %+v", r)
+	data, ok := parseNodeDiscovery(r)
+	if !ok || d.store == nil {
+		return nil
+	}
+	return d.addNode(data)
+}
+
+// DiscoverDelete releases the reservations of nodes that left in global scope
+func (d *Driver) DiscoverDelete(r *sdk.DiscoveryNotification) (err error) {
+	l := newCallLog("DiscoverDelete", "", "", "")
+	defer l.end(&err)
+	if err := d.startCall(); err != nil {
+		return err
+	}
+	defer d.calls.Done()
+	l.Debugf("Discover delete request: %+v", r)
+	data, ok := parseNodeDiscovery(r)
+	if !ok || d.store == nil {
+		return nil
+	}
+	d.removeNode(data)
 	return nil
 }
 
 // existingNetChecks checks for networks that already exist in libnetwork cache
-func (d *Driver) existingNetChecks() {
+func (d *Driver) existingNetChecks(l *callLog) {
+	d.netChecks.Lock()
+	defer d.netChecks.Unlock()
 	// Request all networks on the endpoint without any filters
 	existingNets, err := d.client.ListNetworks("")
 	if err != nil {
@@ -264,31 +822,51 @@ func (d *Driver) existingNetChecks() {
 	var netCidr *net.IPNet
 	var netGW string
 	for _, n := range existingNets {
+		// Networks already in the table keep their endpoints
+		if _, err := d.getNetwork(n.ID); err == nil {
+			continue
+		}
 		// Exclude the default network names
 		if n.Name != "" && n.Name != "none" && n.Name != "host" && n.Name != "bridge" {
-			for _, v4 := range n.IPAM.Config {
-				netGW = v4.Gateway
-				netCidr, err = parseIPNet(v4.Subnet)
+			var netCidr6 *net.IPNet
+			for _, conf := range n.IPAM.Config {
+				_, subnet, err := net.ParseCIDR(conf.Subnet)
 				if err != nil {
-					log.Errorf("invalid cidr address in network [ %s ]: %v", v4.Subnet, err)
+					log.Errorf("invalid cidr address in network [ %s ]: %v", conf.Subnet, err)
+					continue
+				}
+				if subnet.IP.To4() == nil {
+					netCidr6 = subnet
+					continue
 				}
+				netGW = conf.Gateway
+				netCidr = subnet
 			}
 			nw := &network{
 				id:        n.ID,
 				endpoints: endpointTable{},
 				cidr:      netCidr,
+				cidr6:     netCidr6,
 				gateway:   netGW,
 			}
+			// Infer a macvlan network from required option, vxlan parents have a default name
+			_, hasIface := n.Options[optHostIface]
+			_, hasVxlan := n.Options[optVxlanID]
+			if !hasIface && !hasVxlan {
+				continue
+			}
 			// Parse docker network -o opts
-			for k, v := range n.Options {
-				// Infer a macvlan network from required option
-				if k == "host_iface" {
-					nw.ifaceOpt = v
-					log.Debugf("Existing macvlan network exists: [Name:%s, Cidr:%s, Gateway:%s, Master Iface:%s]",
-						n.Name, netCidr.String(), netGW, nw.ifaceOpt)
-					d.addNetwork(nw)
-				}
+			if err := nw.setOptions(n.Options); err != nil {
+				log.Errorf("invalid options in existing network [ %s ]: %s", n.Name, err)
+			}
+			unlock := d.linkLocks.lock(nw.hostKeys()...)
+			if err := nw.setupHost(l.with(nw.id, "")); err != nil {
+				log.Errorf("unable to set up the parent of existing network [ %s ]: %s", n.Name, err)
 			}
+			unlock()
+			log.Debugf("Existing macvlan network exists: [Name:%s, Cidr:%s, Gateway:%s, Master Iface:%s]",
+				n.Name, netCidr.String(), netGW, nw.ifaceOpt)
+			d.addNetwork(nw)
 		}
 	}
 }
@@ -0,0 +1,98 @@
+package macvlan
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+)
+
+const (
+	// macAddressOption is the libnetwork label docker run --mac-address is sent with
+	macAddressOption = "com.docker.network.endpoint.macaddress"
+
+	optMacAddress = "mac_address"
+	// ip_address and ipv6_address are rejected, see checkAddressOptions
+	optIPAddress   = "ip_address"
+	optIPv6Address = "ipv6_address"
+)
+
+// endpointAddress parses an address allocated by libnetwork ipam, either
+// picked from the pool or requested with --ip/--ip6
+func endpointAddress(allocated string, pool *net.IPNet) (*net.IPNet, error) {
+	if allocated == "" {
+		return nil, nil
+	}
+	addr, err := parseIPNet(allocated)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint address [ %s ]: %s", allocated, err)
+	}
+	if pool != nil && !pool.Contains(addr.IP) {
+		return nil, fmt.Errorf("endpoint address [ %s ] is not in the network subnet [ %s ]", addr.IP, pool)
+	}
+	return addr, nil
+}
+
+// checkAddressOptions rejects the address driver options. libnetwork ipam
+// always allocates the endpoint address before the driver sees it, so an
+// address picked by the driver would be neither used nor reserved.
+func checkAddressOptions(opts map[string]string) error {
+	for _, key := range []string{optIPAddress, optIPv6Address} {
+		if _, ok := opts[key]; ok {
+			return fmt.Errorf("--driver-opt %s is not supported, use docker run or docker network connect --ip/--ip6 instead", key)
+		}
+	}
+	return nil
+}
+
+// endpointMac returns the mac requested with docker run --mac-address or the
+// mac_address driver option. libnetwork sends the former base64 encoded.
+func endpointMac(iface string, opts map[string]string) (net.HardwareAddr, error) {
+	for _, s := range []string{iface, opts[macAddressOption], opts[optMacAddress]} {
+		if s == "" {
+			continue
+		}
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			b, decodeErr := base64.StdEncoding.DecodeString(s)
+			if decodeErr != nil || len(b) != 6 {
+				return nil, fmt.Errorf("invalid endpoint mac address [ %s ]: %s", s, err)
+			}
+			mac = net.HardwareAddr(b)
+		}
+		if len(mac) != 6 || mac[0]&0x01 != 0 || bytes.Equal(mac, make(net.HardwareAddr, 6)) {
+			return nil, fmt.Errorf("endpoint mac address [ %s ] must be a non-zero unicast ethernet address", mac)
+		}
+		return mac, nil
+	}
+	return nil, nil
+}
+
+// checkEndpointConflicts verifies an endpoint's mac is unique on the parent
+// interface, macvlan links on the same parent can't share one, and that a
+// driver supplied address isn't in use on the network.
+func (d *Driver) checkEndpointConflicts(n *network, ep *endpoint) error {
+	for _, nw := range d.getNetworks() {
+		if nw.ifaceOpt != n.ifaceOpt {
+			continue
+		}
+		for _, other := range nw.getEndpoints() {
+			if other.id == ep.id {
+				continue
+			}
+			if ep.mac != nil && bytes.Equal(other.mac, ep.mac) {
+				return fmt.Errorf("mac address [ %s ] is already used by endpoint [ %s ] on parent [ %s ]", ep.mac, other.id, n.ifaceOpt)
+			}
+			if nw != n {
+				continue
+			}
+			if ep.addr != nil && other.addr != nil && other.addr.IP.Equal(ep.addr.IP) {
+				return fmt.Errorf("address [ %s ] is already used by endpoint [ %s ]", ep.addr.IP, other.id)
+			}
+			if ep.addrv6 != nil && other.addrv6 != nil && other.addrv6.IP.Equal(ep.addrv6.IP) {
+				return fmt.Errorf("address [ %s ] is already used by endpoint [ %s ]", ep.addrv6.IP, other.id)
+			}
+		}
+	}
+	return nil
+}
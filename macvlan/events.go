@@ -0,0 +1,283 @@
+package macvlan
+
+import (
+	"net"
+	"regexp"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	eventsRetryInterval = 5 * time.Second
+	// endpoints younger than this may not be listed on their container yet
+	staleEndpointGrace = time.Minute
+	// resyncInterval catches up on changes the event stream missed
+	resyncInterval = 5 * time.Minute
+	// resyncStale is how long after the last resync the reconciler is reported unhealthy
+	resyncStale = 2*resyncInterval + time.Minute
+)
+
+// host links are named after the first characters of the endpoint ID
+var hostLinkPattern = regexp.MustCompile("^[0-9a-f]{5}$")
+
+// watchEvents keeps the endpoint table in sync with docker. If dockerd
+// crashes mid-operation DeleteEndpoint may never be called, so container and
+// network events are used to clean up the host links left behind. Every
+// (re)connect to the event stream starts with a full resync.
+func (d *Driver) watchEvents() {
+	for {
+		d.resync()
+		stream, err := d.monitorEvents()
+		if err != nil {
+			log.Warnf("Unable to subscribe to docker events, retrying in %s: %s", eventsRetryInterval, err)
+		} else {
+			log.Debugf("Subscribed to docker container and network events")
+			d.readEvents(stream)
+		}
+		select {
+		case <-d.stop:
+			return
+		case <-time.After(eventsRetryInterval):
+		}
+	}
+}
+
+// watchResync resyncs periodically while the event stream is connected
+func (d *Driver) watchResync() {
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-time.After(resyncInterval):
+			d.resync()
+		}
+	}
+}
+
+// readEvents handles events until the stream fails or the driver is shut down
+func (d *Driver) readEvents(stream *eventStream) {
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-d.stop:
+			stream.Close()
+		case <-closed:
+		}
+	}()
+	defer stream.Close()
+	for {
+		e, err := stream.Next()
+		if err != nil {
+			select {
+			case <-d.stop:
+			default:
+				log.Warnf("Docker event stream closed, resubscribing in %s: %s", eventsRetryInterval, err)
+			}
+			return
+		}
+		d.handleEvent(e)
+	}
+}
+
+func (d *Driver) handleEvent(e *dockerclient.Event) {
+	l := newCallLog("DockerEvent "+e.Type+" "+e.Action, "", "", "")
+	switch e.Type {
+	case "network":
+		n, err := d.getNetwork(e.Actor.ID)
+		if err != nil {
+			// not a macvlan network
+			return
+		}
+		cid := e.Actor.Attributes["container"]
+		log.Debugf("Network event [ %s ] network [ %s ] container [ %s ]", e.Action, n.id, cid)
+		switch e.Action {
+		case "connect":
+			d.trackContainer(n, cid)
+		case "disconnect":
+			for _, ep := range n.containerEndpoints(cid) {
+				d.releaseEndpoint(l, n, ep)
+			}
+		case "destroy":
+			for _, ep := range n.getEndpoints() {
+				d.releaseEndpoint(l, n, ep)
+			}
+			// DeleteNetwork may have torn the network down in the meantime
+			unlock := d.netLocks.lock(n.id)
+			if cur, err := d.getNetwork(n.id); err == nil && cur == n {
+				d.teardownNetwork(l.with(n.id, ""), n)
+			}
+			unlock()
+		}
+	case "container":
+		if e.Action != "die" && e.Action != "destroy" {
+			return
+		}
+		cid := e.Actor.ID
+		for _, n := range d.getNetworks() {
+			for _, ep := range n.containerEndpoints(cid) {
+				log.Debugf("Container event [ %s ] container [ %s ] endpoint [ %s ]", e.Action, cid, ep.id)
+				if e.Action == "destroy" {
+					d.releaseEndpoint(l, n, ep)
+				} else {
+					unlock := d.netLocks.lock(n.id)
+					d.deleteEndpointLink(l.with(n.id, ep.id), n, ep)
+					unlock()
+				}
+			}
+		}
+	}
+}
+
+// trackContainer looks up the endpoint a container was connected with
+func (d *Driver) trackContainer(n *network, cid string) {
+	info, err := d.inspectContainer(cid)
+	if err != nil {
+		log.Warnf("Unable to inspect container [ %s ] connected to network [ %s ]: %s", cid, n.id, err)
+		return
+	}
+	for _, es := range info.NetworkSettings.Networks {
+		if es.NetworkID == n.id {
+			n.setContainer(es.EndpointID, cid)
+		}
+	}
+}
+
+// releaseEndpoint removes the host link and parent filters left behind by an
+// endpoint and drops it from the table, as DeleteEndpoint would have
+func (d *Driver) releaseEndpoint(l *callLog, n *network, ep *endpoint) {
+	defer d.netLocks.lock(n.id)()
+	l = l.with(n.id, ep.id)
+	if err := d.deleteParentAntiSpoof(l, n, ep); err != nil {
+		l.Errorf("%s", err)
+	}
+	if d.deleteEndpointLink(l, n, ep) {
+		log.Infof("Removed the leftover macvlan link for endpoint [ %s ]", ep.id)
+	}
+	if d.store != nil {
+		d.releaseEndpointKeys(n.id, ep)
+	}
+	n.deleteEndpoint(ep.id)
+}
+
+// deleteEndpointLink deletes the host link of an endpoint, returning true if
+// it existed. Callers hold the network lock.
+func (d *Driver) deleteEndpointLink(l *callLog, n *network, ep *endpoint) bool {
+	defer d.linkLocks.lock(n.ifaceOpt)()
+	return deleteHostLink(l, hostLinkName(ep.id))
+}
+
+// resync rebuilds the container to endpoint mappings from the docker
+// container list, releases endpoints docker no longer knows about and
+// removes orphaned macvlan links on the parent interfaces
+func (d *Driver) resync() {
+	d.resyncs.Lock()
+	defer d.resyncs.Unlock()
+	l := newCallLog("Resync", "", "", "")
+	d.existingNetChecks(l)
+	started := time.Now()
+	containers, err := d.listContainers()
+	if err != nil {
+		log.Warnf("Unable to list containers to resync endpoints: %s", err)
+		return
+	}
+	live := make(map[string]bool)
+	// links of endpoints docker knows are kept even on networks the driver doesn't
+	known := make(map[string]bool)
+	for _, c := range containers {
+		for _, es := range c.NetworkSettings.Networks {
+			if es.EndpointID == "" {
+				continue
+			}
+			live[es.EndpointID] = true
+			known[hostLinkName(es.EndpointID)] = true
+			n, err := d.getNetwork(es.NetworkID)
+			if err != nil {
+				continue
+			}
+			if ep := n.endpoint(es.EndpointID); ep == nil {
+				n.addEndpoint(discoveredEndpoint(&es))
+			}
+			n.setContainer(es.EndpointID, c.Id)
+		}
+	}
+	// orphans are only looked for among the links created for the networks
+	owners := make(map[string]bool)
+	for _, n := range d.getNetworks() {
+		owners[endpointLinkAlias(n.id)] = true
+		for _, ep := range n.getEndpoints() {
+			if !live[ep.id] && started.Sub(ep.created) > staleEndpointGrace {
+				log.Infof("Endpoint [ %s ] no longer exists in docker, releasing it", ep.id)
+				d.releaseEndpoint(l, n, ep)
+				continue
+			}
+			known[hostLinkName(ep.id)] = true
+		}
+	}
+	// endpoints created since the table was read are looked up again before deleting
+	deleteOrphanLinks(l, owners, func(name string) bool {
+		return known[name] || d.hasEndpointLink(name)
+	})
+	d.Lock()
+	d.resynced = started
+	d.Unlock()
+}
+
+// lastResync returns when the last resync started, zero until one completes
+func (d *Driver) lastResync() time.Time {
+	d.Lock()
+	defer d.Unlock()
+	return d.resynced
+}
+
+// discoveredEndpoint creates a table entry for an endpoint the driver learnt about from docker
+func discoveredEndpoint(es *dockerclient.EndpointSettings) *endpoint {
+	ep := &endpoint{
+		id: es.EndpointID,
+	}
+	if ip := net.ParseIP(es.IPAddress); ip != nil {
+		ep.addr = &net.IPNet{IP: ip, Mask: net.CIDRMask(es.IPPrefixLen, 32)}
+	}
+	if mac, err := net.ParseMAC(es.MacAddress); err == nil {
+		ep.mac = mac
+	}
+	return ep
+}
+
+// deleteOrphanLinks removes the macvlan and macvtap links the driver created
+// for a network, recorded in their alias, that are still in the host netns
+// and don't belong to an endpoint of the driver or docker
+func deleteOrphanLinks(l *callLog, owners map[string]bool, known func(string) bool) {
+	links, err := linkOps.LinkList()
+	if err != nil {
+		log.Warnf("Unable to list host links: %s", err)
+		return
+	}
+	for _, link := range links {
+		attrs := link.Attrs()
+		if (link.Type() != linkTypeMacvlan && link.Type() != linkTypeMacvtap) || !owners[attrs.Alias] {
+			continue
+		}
+		if !hostLinkPattern.MatchString(attrs.Name) || known(attrs.Name) {
+			continue
+		}
+		log.Infof("Deleting the orphaned %s link [ %s ]", link.Type(), attrs.Name)
+		if err := l.audit(auditLinkDel, attrs.Name, "orphan", linkOps.LinkDel(link)); err != nil {
+			log.Errorf("unable to delete the orphaned %s link [ %s ]: %s", link.Type(), attrs.Name, err)
+		}
+	}
+}
+
+// hasEndpointLink reports whether a host link name belongs to an endpoint in the table
+func (d *Driver) hasEndpointLink(name string) bool {
+	for _, n := range d.getNetworks() {
+		for _, ep := range n.getEndpoints() {
+			if hostLinkName(ep.id) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
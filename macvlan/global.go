@@ -0,0 +1,327 @@
+package macvlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	sdk "github.com/docker/go-plugins-helpers/network"
+)
+
+// Key layout of the global scope store
+const (
+	networksKey  = storePrefix + "networks/"
+	addressesKey = storePrefix + "addresses/"
+	macsKey      = storePrefix + "macs/"
+	nodesKey     = storePrefix + "nodes/"
+)
+
+// networkRecord is the network config shared between hosts
+type networkRecord struct {
+	ID      string            `json:"id"`
+	Pool    string            `json:"pool,omitempty"`
+	Gateway string            `json:"gateway,omitempty"`
+	Pool6   string            `json:"pool6,omitempty"`
+	Options map[string]string `json:"options"`
+}
+
+// reservation records the endpoint and node holding an address or mac
+type reservation struct {
+	Endpoint string `json:"endpoint"`
+	Node     string `json:"node"`
+}
+
+// nodeDiscovery is the libnetwork discoverapi type of node notifications
+const nodeDiscovery = 1
+
+// nodeDiscoveryData is the libnetwork discoverapi.NodeDiscoveryData
+type nodeDiscoveryData struct {
+	Address     string
+	BindAddress string
+	Self        bool
+}
+
+// nodeRecord is a host discovered through DiscoverNew. Name is the node
+// name the host makes its reservations under, recorded by the host itself.
+type nodeRecord struct {
+	Address string    `json:"address"`
+	Name    string    `json:"name,omitempty"`
+	Self    bool      `json:"self"`
+	Seen    time.Time `json:"seen"`
+}
+
+// setupScope opens the store of a global scope driver
+func (d *Driver) setupScope(scope, storeURI string) error {
+	switch scope {
+	case "", scopeLocal:
+		d.scope = sdk.LocalScope
+		if storeURI != "" {
+			log.Warnf("--store is only used with --scope=%s, ignoring [ %s ]", scopeGlobal, storeURI)
+		}
+		return nil
+	case scopeGlobal:
+		if storeURI == "" {
+			return fmt.Errorf("--scope=%s requires a --store", scopeGlobal)
+		}
+		store, err := newStore(storeURI)
+		if err != nil {
+			return err
+		}
+		d.scope, d.store = sdk.GlobalScope, store
+		// reservations are made under the host name, the node record of the
+		// address libnetwork discovers for this host maps it back
+		if d.node, err = os.Hostname(); err != nil {
+			return err
+		}
+		log.Infof("Global scope, networks and allocations are coordinated through [ %s ]", storeURI)
+		return nil
+	default:
+		return fmt.Errorf("invalid --scope [ %s ], expected %s or %s", scope, scopeLocal, scopeGlobal)
+	}
+}
+
+// saveNetwork records a network in the store, networks created by another host are kept
+func (d *Driver) saveNetwork(n *network, opts map[string]string) error {
+	rec := &networkRecord{ID: n.id, Gateway: n.gateway, Options: opts}
+	if n.cidr != nil {
+		rec.Pool = n.cidr.String()
+	}
+	if n.cidr6 != nil {
+		rec.Pool6 = n.cidr6.String()
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := d.store.AtomicPut(networksKey+n.id, b, 0); err != nil && err != errKeyModified {
+		return fmt.Errorf("unable to save network [ %s ] to the store: %s", n.id, err)
+	}
+	return nil
+}
+
+// loadNetwork rebuilds a network from the store
+func (d *Driver) loadNetwork(l *callLog, nid string) (*network, error) {
+	b, _, err := d.store.Get(networksKey + nid)
+	if err != nil {
+		return nil, err
+	}
+	rec := &networkRecord{}
+	if err := json.Unmarshal(b, rec); err != nil {
+		return nil, err
+	}
+	n := &network{
+		id:        rec.ID,
+		endpoints: endpointTable{},
+		gateway:   rec.Gateway,
+	}
+	if rec.Pool != "" {
+		if _, n.cidr, err = net.ParseCIDR(rec.Pool); err != nil {
+			return nil, err
+		}
+	}
+	if rec.Pool6 != "" {
+		if _, n.cidr6, err = net.ParseCIDR(rec.Pool6); err != nil {
+			return nil, err
+		}
+	}
+	if err := n.setOptions(rec.Options); err != nil {
+		return nil, err
+	}
+	unlock := d.linkLocks.lock(n.hostKeys()...)
+	err = n.setupHost(l)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Loaded network [ %s ] from the store", nid)
+	return n, nil
+}
+
+// removeNetwork deletes a network and its reservations from the store
+func (d *Driver) removeNetwork(nid string) {
+	prefixes := []string{networksKey + nid, addressesKey + nid + "/", macsKey + nid + "/"}
+	for _, prefix := range prefixes {
+		d.deleteKeys(prefix, func([]byte) bool { return true })
+	}
+}
+
+// reserveEndpoint claims the endpoint addresses and mac for this host. Other
+// hosts on the same network get an error instead of a duplicate.
+func (d *Driver) reserveEndpoint(nid string, ep *endpoint) error {
+	b, err := json.Marshal(&reservation{Endpoint: ep.id, Node: d.nodeName()})
+	if err != nil {
+		return err
+	}
+	var claimed []string
+	for _, key := range endpointKeys(nid, ep) {
+		if _, err := d.store.AtomicPut(key, b, 0); err != nil {
+			if err == errKeyModified {
+				err = d.conflict(key, ep.id)
+			}
+			if err != nil {
+				for _, k := range claimed {
+					d.releaseKey(k, ep.id)
+				}
+				return err
+			}
+			continue
+		}
+		claimed = append(claimed, key)
+	}
+	return nil
+}
+
+// conflict returns nil if key is already held by the endpoint itself
+func (d *Driver) conflict(key, eid string) error {
+	b, _, err := d.store.Get(key)
+	if err != nil {
+		return err
+	}
+	res := &reservation{}
+	if err := json.Unmarshal(b, res); err != nil {
+		return err
+	}
+	if res.Endpoint == eid {
+		return nil
+	}
+	what := key[strings.LastIndex(key, "/")+1:]
+	return fmt.Errorf("[ %s ] is already used by endpoint [ %s ] on node [ %s ]", what, res.Endpoint, res.Node)
+}
+
+// releaseEndpointKeys releases the store reservations of an endpoint
+func (d *Driver) releaseEndpointKeys(nid string, ep *endpoint) {
+	for _, key := range endpointKeys(nid, ep) {
+		d.releaseKey(key, ep.id)
+	}
+}
+
+func (d *Driver) releaseKey(key, eid string) {
+	b, version, err := d.store.Get(key)
+	if err != nil {
+		if err != errKeyNotFound {
+			log.Warnf("Unable to release [ %s ] from the store: %s", key, err)
+		}
+		return
+	}
+	res := &reservation{}
+	if json.Unmarshal(b, res) == nil && res.Endpoint != eid {
+		return
+	}
+	if err := d.store.AtomicDelete(key, version); err != nil {
+		log.Warnf("Unable to release [ %s ] from the store: %s", key, err)
+	}
+}
+
+// deleteKeys deletes the keys under a prefix whose value matches
+func (d *Driver) deleteKeys(prefix string, match func([]byte) bool) {
+	values, err := d.store.List(prefix)
+	if err != nil {
+		log.Warnf("Unable to list [ %s ] in the store: %s", prefix, err)
+		return
+	}
+	for key, value := range values {
+		if !match(value) {
+			continue
+		}
+		_, version, err := d.store.Get(key)
+		if err != nil {
+			continue
+		}
+		if err := d.store.AtomicDelete(key, version); err != nil {
+			log.Warnf("Unable to delete [ %s ] from the store: %s", key, err)
+		}
+	}
+}
+
+func endpointKeys(nid string, ep *endpoint) []string {
+	var keys []string
+	for _, addr := range []*net.IPNet{ep.addr, ep.addrv6} {
+		if addr != nil {
+			keys = append(keys, addressesKey+nid+"/"+addr.IP.String())
+		}
+	}
+	if ep.mac != nil {
+		keys = append(keys, macsKey+nid+"/"+ep.mac.String())
+	}
+	return keys
+}
+
+func (d *Driver) nodeName() string {
+	d.Lock()
+	defer d.Unlock()
+	return d.node
+}
+
+// parseNodeDiscovery decodes the DiscoveryData of a node discovery notification
+func parseNodeDiscovery(r *sdk.DiscoveryNotification) (*nodeDiscoveryData, bool) {
+	if r.DiscoveryType != nodeDiscovery {
+		return nil, false
+	}
+	b, err := json.Marshal(r.DiscoveryData)
+	if err != nil {
+		return nil, false
+	}
+	data := &nodeDiscoveryData{}
+	if err := json.Unmarshal(b, data); err != nil || data.Address == "" {
+		return nil, false
+	}
+	return data, true
+}
+
+// addNode records a discovered host. A host records its own address along
+// with its node name, which is kept when other hosts refresh the record.
+func (d *Driver) addNode(data *nodeDiscoveryData) error {
+	rec := &nodeRecord{Address: data.Address, Self: data.Self, Seen: time.Now()}
+	if data.Self {
+		rec.Name = d.nodeName()
+	}
+	key := nodesKey + data.Address
+	b, version, err := d.store.Get(key)
+	if err != nil && err != errKeyNotFound {
+		return err
+	}
+	prev := &nodeRecord{}
+	if err == nil && rec.Name == "" && json.Unmarshal(b, prev) == nil {
+		rec.Name = prev.Name
+	}
+	if b, err = json.Marshal(rec); err != nil {
+		return err
+	}
+	if _, err := d.store.AtomicPut(key, b, version); err != nil && err != errKeyModified {
+		return err
+	}
+	log.Infof("Discovered node [ %s ]", data.Address)
+	return nil
+}
+
+// removeNode forgets a host that left and releases the reservations made
+// under the node name it recorded for its address
+func (d *Driver) removeNode(data *nodeDiscoveryData) {
+	key := nodesKey + data.Address
+	b, version, err := d.store.Get(key)
+	if err != nil {
+		if err != errKeyNotFound {
+			log.Warnf("Unable to read node [ %s ] from the store: %s", data.Address, err)
+		}
+		return
+	}
+	rec := &nodeRecord{}
+	if err := json.Unmarshal(b, rec); err != nil || rec.Name == "" {
+		log.Warnf("Node [ %s ] left without recording its name, its reservations are kept", data.Address)
+	} else {
+		heldBy := func(b []byte) bool {
+			res := &reservation{}
+			return json.Unmarshal(b, res) == nil && res.Node == rec.Name
+		}
+		d.deleteKeys(addressesKey, heldBy)
+		d.deleteKeys(macsKey, heldBy)
+		log.Infof("Node [ %s ] left, released the reservations of [ %s ]", data.Address, rec.Name)
+	}
+	if err := d.store.AtomicDelete(key, version); err != nil && err != errKeyModified {
+		log.Warnf("Unable to delete [ %s ] from the store: %s", key, err)
+	}
+}
@@ -0,0 +1,72 @@
+package macvlan
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func testEndpoint(id, ip, mac string) *endpoint {
+	hw, _ := net.ParseMAC(mac)
+	return &endpoint{id: id, addr: &net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(24, 32)}, mac: hw}
+}
+
+// TestRemoveNode checks a node leaving only releases its own reservations,
+// the ones it made under its host name before and after discovery
+func TestRemoveNode(t *testing.T) {
+	srv := httptest.NewServer(newFakeEtcd())
+	defer srv.Close()
+	store, err := newStore("etcd://" + srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostA := &Driver{store: store, node: "host-a"}
+	hostB := &Driver{store: store, node: "host-b"}
+	epA := testEndpoint("ep-a", "192.168.1.10", "7a:42:c0:a8:01:0a")
+	epA2 := testEndpoint("ep-a2", "192.168.1.11", "7a:42:c0:a8:01:0b")
+	epB := testEndpoint("ep-b", "192.168.1.20", "7a:42:c0:a8:01:14")
+
+	// reservations made before libnetwork discovers the host
+	if err := hostA.reserveEndpoint("net1", epA); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []struct {
+		d    *Driver
+		addr string
+	}{{hostA, "10.0.0.1"}, {hostB, "10.0.0.10"}} {
+		if err := n.d.addNode(&nodeDiscoveryData{Address: n.addr, Self: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// another host refreshing the record keeps the name
+	if err := hostB.addNode(&nodeDiscoveryData{Address: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := hostA.reserveEndpoint("net1", epA2); err != nil {
+		t.Fatal(err)
+	}
+	if err := hostB.reserveEndpoint("net1", epB); err != nil {
+		t.Fatal(err)
+	}
+
+	hostB.removeNode(&nodeDiscoveryData{Address: "10.0.0.1"})
+
+	for _, ep := range []*endpoint{epA, epA2} {
+		for _, key := range endpointKeys("net1", ep) {
+			if _, _, err := store.Get(key); err != errKeyNotFound {
+				t.Errorf("reservation [ %s ] of the removed node wasn't released: %v", key, err)
+			}
+		}
+	}
+	for _, key := range endpointKeys("net1", epB) {
+		if _, _, err := store.Get(key); err != nil {
+			t.Errorf("reservation [ %s ] of node 10.0.0.10 was released: %v", key, err)
+		}
+	}
+	if _, _, err := store.Get(nodesKey + "10.0.0.1"); err != errKeyNotFound {
+		t.Errorf("the record of the removed node is still in the store: %v", err)
+	}
+	if _, _, err := store.Get(nodesKey + "10.0.0.10"); err != nil {
+		t.Errorf("the record of node 10.0.0.10 was removed: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package macvlan
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// checks reported by HealthCheck
+const (
+	healthDocker     = "docker"
+	healthStore      = "store"
+	healthParents    = "parents"
+	healthReconciler = "reconciler"
+	// healthKey is rewritten by every store check
+	healthKey = storePrefix + "health/"
+)
+
+// HealthReport is the state of the driver returned by the admin /healthz
+type HealthReport struct {
+	Healthy bool           `json:"healthy"`
+	Checks  []*CheckResult `json:"checks"`
+	// LastResync is when the last completed resync started
+	LastResync time.Time       `json:"last_resync"`
+	Parents    []*ParentHealth `json:"parents"`
+}
+
+// CheckResult is the outcome of one health check
+type CheckResult struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// HealthCheck checks that the docker API is reachable, the store writable,
+// the parent interfaces present and up and that the reconciler ran recently
+func (d *Driver) HealthCheck() *HealthReport {
+	r := &HealthReport{Healthy: true, LastResync: d.lastResync(), Parents: d.Health()}
+	r.add(healthDocker, d.ping())
+	r.add(healthStore, d.checkStore())
+	var down []string
+	for _, h := range r.Parents {
+		if !h.Up {
+			down = append(down, h.Name)
+		}
+	}
+	if len(down) > 0 {
+		r.add(healthParents, fmt.Errorf("parent interfaces [ %s ] are missing or down", strings.Join(down, ", ")))
+	} else {
+		r.add(healthParents, nil)
+	}
+	if age := time.Since(r.LastResync); age > resyncStale {
+		if r.LastResync.IsZero() {
+			r.add(healthReconciler, fmt.Errorf("the reconciler has not completed since the driver started"))
+		} else {
+			r.add(healthReconciler, fmt.Errorf("the reconciler last completed %s ago", age))
+		}
+	} else {
+		r.add(healthReconciler, nil)
+	}
+	return r
+}
+
+func (r *HealthReport) add(name string, err error) {
+	c := &CheckResult{Name: name, Healthy: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+		r.Healthy = false
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// checkStore writes the health key of this node, local scope has no store to check
+func (d *Driver) checkStore() error {
+	if d.store == nil {
+		return nil
+	}
+	key := healthKey + d.nodeName()
+	_, version, err := d.store.Get(key)
+	if err != nil && err != errKeyNotFound {
+		return err
+	}
+	_, err = d.store.AtomicPut(key, []byte(time.Now().UTC().Format(time.RFC3339)), version)
+	// another check raced this one, the store was still written
+	if err == errKeyModified {
+		return nil
+	}
+	return err
+}
+
+// ParentHealth is the state of a parent interface shared by macvlan networks
+type ParentHealth struct {
+	Name     string            `json:"name"`
+	Kind     string            `json:"kind,omitempty"`
+	Networks []string          `json:"networks"`
+	Slaves   map[string]string `json:"slaves,omitempty"`
+	// Up is set when the parent exists and is administratively up
+	Up bool `json:"up"`
+	// Degraded is set when a bond or team parent has slaves down
+	Degraded bool   `json:"degraded"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (h *ParentHealth) slavesUp() int {
+	up := 0
+	for _, state := range h.Slaves {
+		if state == slaveUp {
+			up++
+		}
+	}
+	return up
+}
+
+// info returns the slave state of bond and team parents as reported by EndpointInfo
+func (h *ParentHealth) info() map[string]string {
+	if len(h.Slaves) == 0 {
+		return nil
+	}
+	slaves := make([]string, 0, len(h.Slaves))
+	for name, state := range h.Slaves {
+		slaves = append(slaves, name+"="+state)
+	}
+	sort.Strings(slaves)
+	return map[string]string{
+		"parent_slaves":   strings.Join(slaves, ","),
+		"parent_degraded": strconv.FormatBool(h.Degraded),
+	}
+}
+
+// Health returns the state of the parent interfaces of every network
+func (d *Driver) Health() []*ParentHealth {
+	parents := make(map[string]bool)
+	for _, n := range d.getNetworks() {
+		if n.ifaceOpt != "" {
+			parents[n.ifaceOpt] = true
+		}
+	}
+	names := make([]string, 0, len(parents))
+	for name := range parents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	health := make([]*ParentHealth, 0, len(names))
+	for _, name := range names {
+		health = append(health, d.parentHealth(name))
+	}
+	return health
+}
+
+func (d *Driver) parentHealth(name string) *ParentHealth {
+	h := &ParentHealth{
+		Name:     name,
+		Networks: d.parentNetworks(name),
+	}
+	kind, slaves, err := parentSlaves(name)
+	if err != nil {
+		log.Debugf("Unable to read the state of parent [ %s ]: %s", name, err)
+		h.Error = err.Error()
+		return h
+	}
+	h.Kind, h.Slaves = kind, slaves
+	if link, err := linkOps.LinkByName(name); err == nil {
+		h.Up = link.Attrs().Flags&net.FlagUp != 0
+	}
+	h.Degraded = h.slavesUp() < len(h.Slaves)
+	return h
+}
+
+// parentNetworks returns the IDs of the networks using a parent interface
+func (d *Driver) parentNetworks(name string) []string {
+	var ids []string
+	for _, n := range d.getNetworks() {
+		if n.ifaceOpt == name {
+			ids = append(ids, n.id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
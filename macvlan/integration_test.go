@@ -0,0 +1,376 @@
+package macvlan_test
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	sdk "github.com/docker/go-plugins-helpers/network"
+	"github.com/gopher-net/macvlan-docker-plugin/macvlan"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// integrationChildEnv marks the re-executed test binary running in the throwaway netns
+	integrationChildEnv = "MACVLAN_INTEGRATION_NETNS"
+	// integrationDockerHost has no dockerd behind it, a real one would
+	// release the test endpoints it doesn't know about
+	integrationDockerHost = "unix:///nonexistent/macvlan-integration/docker.sock"
+	integrationParent     = "itparent0"
+	integrationPeer       = "itpeer0"
+	// the parent MTU differs from the driver's so an inherited MTU is caught
+	integrationParentMTU = 9000
+	integrationMTU       = 1500
+	integrationSubnet    = "10.230.0.0/24"
+	integrationGateway   = "10.230.0.1/24"
+	integrationWait      = 5 * time.Second
+)
+
+// TestIntegration drives the driver against real links. It re-runs itself
+// in a throwaway netns with a dummy or veth parent, which the kernel
+// destroys with every link in it when the child exits.
+func TestIntegration(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the integration checks have to run as root")
+	}
+	if os.Getenv(integrationChildEnv) == "" {
+		reexecInNetns(t)
+		return
+	}
+	// the driver logs errors looking for the absent dockerd
+	log.SetOutput(ioutil.Discard)
+	if testing.Verbose() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(log.DebugLevel)
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		t.Fatalf("unable to make the mounts private: %s", err)
+	}
+	if err := syscall.Mount("sysfs", "/sys", "sysfs", 0, ""); err != nil {
+		t.Fatalf("unable to mount the netns sysfs: %s", err)
+	}
+	lo, err := netlink.LinkByName("lo")
+	if err == nil {
+		err = netlink.LinkSetUp(lo)
+	}
+	if err != nil {
+		t.Fatalf("unable to bring up lo: %s", err)
+	}
+	parent, err := addIntegrationParent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline, err := linkNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := flag.NewFlagSet("integration", flag.ContinueOnError)
+	set.String("docker-host", integrationDockerHost, "")
+	d, err := macvlan.NewDriver("integration", cli.NewContext(cli.NewApp(), set, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range integrationCases {
+		if err := c.run(d, parent, i); err != nil {
+			t.Errorf("%s on a [ %s ] parent: %s", c.name, parent.Type(), err)
+		}
+	}
+	if err := d.Shutdown(integrationWait); err != nil {
+		t.Errorf("shutdown: %s", err)
+	}
+	if leaked := leakedLinks(baseline); len(leaked) > 0 {
+		t.Errorf("leaked links [ %s ]", strings.Join(leaked, " "))
+	}
+}
+
+// reexecInNetns runs TestIntegration again in a new netns
+func reexecInNetns(t *testing.T) {
+	args := []string{"-test.run", "^TestIntegration$"}
+	if testing.Verbose() {
+		args = append(args, "-test.v")
+	}
+	cmd := exec.Command("/proc/self/exe", args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), integrationChildEnv+"=1")
+	// a mount namespace too, sysfs has to be remounted to show the new netns
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET | syscall.CLONE_NEWNS}
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			t.Fatal("the checks in the throwaway netns failed")
+		}
+		t.Fatalf("unable to run in a new netns: %s", err)
+	}
+}
+
+// integrationCase is a network and the endpoints joined to it
+type integrationCase struct {
+	name      string
+	opts      map[string]string
+	endpoints int
+	linkType  string
+	mode      netlink.MacvlanMode
+	// pool is the number of links kept ready by -o link_pool
+	pool int
+}
+
+var integrationCases = []integrationCase{
+	{name: "bridge mode", endpoints: 2, linkType: "macvlan", mode: netlink.MACVLAN_MODE_BRIDGE},
+	{name: "private mode", opts: map[string]string{"mode": "private"}, endpoints: 1, linkType: "macvlan", mode: netlink.MACVLAN_MODE_PRIVATE},
+	{name: "vepa mode", opts: map[string]string{"mode": "vepa"}, endpoints: 1, linkType: "macvlan", mode: netlink.MACVLAN_MODE_VEPA},
+	{name: "warm link pool", opts: map[string]string{"link_pool": "2"}, endpoints: 3, linkType: "macvlan", mode: netlink.MACVLAN_MODE_BRIDGE, pool: 2},
+	{name: "macvtap endpoints", opts: map[string]string{"link_type": "macvtap"}, endpoints: 1, linkType: "macvtap", mode: netlink.MACVLAN_MODE_BRIDGE},
+}
+
+// addIntegrationParent creates a dummy parent, or a veth pair on kernels
+// without the dummy module
+func addIntegrationParent() (netlink.Link, error) {
+	attrs := netlink.LinkAttrs{Name: integrationParent, MTU: integrationParentMTU}
+	if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: attrs}); err != nil {
+		veth := &netlink.Veth{LinkAttrs: attrs, PeerName: integrationPeer}
+		if err := netlink.LinkAdd(veth); err != nil {
+			return nil, fmt.Errorf("unable to add a dummy or veth parent: %s", err)
+		}
+	}
+	parent, err := netlink.LinkByName(integrationParent)
+	if err != nil {
+		return nil, err
+	}
+	if err := netlink.LinkSetMTU(parent, integrationParentMTU); err != nil {
+		return nil, err
+	}
+	if err := netlink.LinkSetUp(parent); err != nil {
+		return nil, err
+	}
+	return parent, nil
+}
+
+// run creates the case network and endpoints, checks the joined links and
+// that deleting everything leaves the links the case started with
+func (c integrationCase) run(d *macvlan.Driver, parent netlink.Link, i int) error {
+	before, err := linkNames()
+	if err != nil {
+		return err
+	}
+	nid := randomID()
+	opts := map[string]interface{}{"host_iface": parent.Attrs().Name}
+	for k, v := range c.opts {
+		opts[k] = v
+	}
+	err = d.CreateNetwork(&sdk.CreateNetworkRequest{
+		NetworkID: nid,
+		Options:   map[string]interface{}{"com.docker.network.generic": opts},
+		IPv4Data:  []*sdk.IPAMData{{AddressSpace: "LocalDefault", Pool: integrationSubnet, Gateway: integrationGateway}},
+	})
+	if err != nil {
+		return fmt.Errorf("CreateNetwork: %s", err)
+	}
+	checkErr := c.checkEndpoints(d, parent, nid, i)
+	if err := d.DeleteNetwork(&sdk.DeleteNetworkRequest{NetworkID: nid}); err != nil && checkErr == nil {
+		checkErr = fmt.Errorf("DeleteNetwork: %s", err)
+	}
+	if checkErr != nil {
+		return checkErr
+	}
+	if leaked := leakedLinks(before); len(leaked) > 0 {
+		return fmt.Errorf("links left after DeleteNetwork [ %s ]", strings.Join(leaked, " "))
+	}
+	return nil
+}
+
+func (c integrationCase) checkEndpoints(d *macvlan.Driver, parent netlink.Link, nid string, i int) error {
+	if c.pool > 0 {
+		if err := waitForPool(parent, c.pool); err != nil {
+			return err
+		}
+	}
+	_, subnet, _ := net.ParseCIDR(integrationSubnet)
+	var joined []*sdk.DeleteEndpointRequest
+	var names []string
+	defer func() {
+		for _, r := range joined {
+			d.DeleteEndpoint(r)
+		}
+	}()
+	for e := 0; e < c.endpoints; e++ {
+		eid := randomID()
+		addr := &net.IPNet{IP: subnetHost(subnet, uint32(2+i*16+e)), Mask: subnet.Mask}
+		res, err := d.CreateEndpoint(&sdk.CreateEndpointRequest{
+			NetworkID:  nid,
+			EndpointID: eid,
+			Interface:  &sdk.EndpointInterface{Address: addr.String()},
+		})
+		if err != nil {
+			return fmt.Errorf("CreateEndpoint: %s", err)
+		}
+		joined = append(joined, &sdk.DeleteEndpointRequest{NetworkID: nid, EndpointID: eid})
+		join, err := d.Join(&sdk.JoinRequest{NetworkID: nid, EndpointID: eid, SandboxKey: "/var/run/docker/netns/integration-" + eid[:12]})
+		if err != nil {
+			return fmt.Errorf("Join: %s", err)
+		}
+		// libnetwork would move the link into the sandbox here, it stays in
+		// the host netns so the driver deletes it with the endpoint
+		names = append(names, join.InterfaceName.SrcName)
+		// the driver derives the mac from the address unless it picked one
+		mac := res.Interface.MacAddress
+		if mac == "" {
+			mac = net.HardwareAddr(append([]byte{0x7a, 0x42}, addr.IP.To4()...)).String()
+		}
+		if err := c.checkLink(join.InterfaceName.SrcName, parent, mac); err != nil {
+			return err
+		}
+		if join.Gateway != strings.Split(integrationGateway, "/")[0] {
+			return fmt.Errorf("Join returned the gateway [ %s ]", join.Gateway)
+		}
+		if err := d.Leave(&sdk.LeaveRequest{NetworkID: nid, EndpointID: eid}); err != nil {
+			return fmt.Errorf("Leave: %s", err)
+		}
+		// the link left on the host is where libnetwork leaves it after a
+		// Leave, joining the endpoint again has to replace it
+		if join, err = d.Join(&sdk.JoinRequest{NetworkID: nid, EndpointID: eid, SandboxKey: "/var/run/docker/netns/integration-" + eid[:12]}); err != nil {
+			return fmt.Errorf("rejoin: %s", err)
+		}
+		if err := c.checkLink(join.InterfaceName.SrcName, parent, mac); err != nil {
+			return fmt.Errorf("rejoin: %s", err)
+		}
+		if err := d.Leave(&sdk.LeaveRequest{NetworkID: nid, EndpointID: eid}); err != nil {
+			return fmt.Errorf("Leave after rejoin: %s", err)
+		}
+	}
+	for e, r := range joined {
+		if err := d.DeleteEndpoint(r); err != nil {
+			return fmt.Errorf("DeleteEndpoint: %s", err)
+		}
+		if linkExists(names[e]) {
+			return fmt.Errorf("link [ %s ] is left after DeleteEndpoint", names[e])
+		}
+	}
+	joined = nil
+	return nil
+}
+
+// checkLink verifies the joined endpoint link in the host netns
+func (c integrationCase) checkLink(name string, parent netlink.Link, mac string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("Join link [ %s ] not found: %s", name, err)
+	}
+	attrs := link.Attrs()
+	var mode netlink.MacvlanMode
+	switch l := link.(type) {
+	case *netlink.Macvlan:
+		mode = l.Mode
+	case *netlink.Macvtap:
+		mode = l.Mode
+	}
+	switch {
+	case link.Type() != c.linkType:
+		return fmt.Errorf("link [ %s ] is a [ %s ], expected [ %s ]", name, link.Type(), c.linkType)
+	case attrs.ParentIndex != parent.Attrs().Index:
+		return fmt.Errorf("link [ %s ] isn't on the parent [ %s ]", name, parent.Attrs().Name)
+	case mode != c.mode:
+		return fmt.Errorf("link [ %s ] has mode [ %d ], expected [ %d ]", name, mode, c.mode)
+	case attrs.MTU != integrationMTU:
+		return fmt.Errorf("link [ %s ] has MTU [ %d ], expected [ %d ]", name, attrs.MTU, integrationMTU)
+	case attrs.HardwareAddr.String() != mac:
+		return fmt.Errorf("link [ %s ] has mac [ %s ], expected [ %s ]", name, attrs.HardwareAddr, mac)
+	case attrs.Flags&net.FlagUp == 0:
+		return fmt.Errorf("link [ %s ] is down", name)
+	}
+	return nil
+}
+
+// waitForPool waits for the -o link_pool worker to create its links
+func waitForPool(parent netlink.Link, size int) error {
+	deadline := time.Now().Add(integrationWait)
+	for {
+		links, err := hostLinks(parent.Attrs().Name)
+		if err != nil {
+			return err
+		}
+		if len(links) == size {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the pool has [ %d ] links, expected [ %d ]", len(links), size)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func linkExists(name string) bool {
+	_, err := netlink.LinkByName(name)
+	return err == nil
+}
+
+func linkNames() (map[string]bool, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(links))
+	for _, link := range links {
+		names[link.Attrs().Name] = true
+	}
+	return names, nil
+}
+
+// leakedLinks returns the links that aren't in the baseline
+func leakedLinks(baseline map[string]bool) []string {
+	names, err := linkNames()
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var leaked []string
+	for name := range names {
+		if !baseline[name] {
+			leaked = append(leaked, name)
+		}
+	}
+	sort.Strings(leaked)
+	return leaked
+}
+
+func randomID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// subnetHost returns the n-th address of the subnet
+func subnetHost(subnet *net.IPNet, n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(subnet.IP.To4())+n)
+	return ip
+}
+
+// hostLinks returns the macvlan and macvtap links on a parent
+func hostLinks(parent string) (map[string]bool, error) {
+	p, err := netlink.LinkByName(parent)
+	if err != nil {
+		return nil, err
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, link := range links {
+		if link.Attrs().ParentIndex == p.Attrs().Index && (link.Type() == "macvlan" || link.Type() == "macvtap") {
+			names[link.Attrs().Name] = true
+		}
+	}
+	return names, nil
+}
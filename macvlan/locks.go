@@ -0,0 +1,61 @@
+package macvlan
+
+import (
+	"sort"
+	"sync"
+)
+
+// keyedLocks serializes the operations on one key, a network ID or a host
+// link name, without blocking the operations on other keys. Networks are
+// always locked before links.
+type keyedLocks struct {
+	sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	// refs counts the holders and waiters, the lock is dropped at 0
+	refs int
+}
+
+// lock locks the keys in sorted order so callers locking overlapping sets
+// can't deadlock, and returns the function unlocking them. Empty keys are
+// skipped.
+func (k *keyedLocks) lock(keys ...string) func() {
+	sorted := make([]string, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key != "" && !seen[key] {
+			seen[key] = true
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+	held := make([]*keyedLock, 0, len(sorted))
+	for _, key := range sorted {
+		k.Lock()
+		if k.locks == nil {
+			k.locks = make(map[string]*keyedLock)
+		}
+		l, ok := k.locks[key]
+		if !ok {
+			l = &keyedLock{}
+			k.locks[key] = l
+		}
+		l.refs++
+		k.Unlock()
+		l.Lock()
+		held = append(held, l)
+	}
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].Unlock()
+			k.Lock()
+			if held[i].refs--; held[i].refs == 0 {
+				delete(k.locks, sorted[i])
+			}
+			k.Unlock()
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package macvlan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	sdk "github.com/docker/go-plugins-helpers/network"
+	"github.com/samalba/dockerclient"
+)
+
+// TestKeyedLocks checks overlapping key sets are serialized in any order and
+// the locks are dropped once released
+func TestKeyedLocks(t *testing.T) {
+	var k keyedLocks
+	var mu sync.Mutex
+	held := make(map[string]bool)
+	sets := [][]string{{"a", "b"}, {"b", "a"}, {"c", "a", ""}, {"b", "c", "b"}, {"a"}}
+	var wg sync.WaitGroup
+	for i := 0; i < 400; i++ {
+		wg.Add(1)
+		go func(keys []string) {
+			defer wg.Done()
+			unlock := k.lock(keys...)
+			defer unlock()
+			set := make(map[string]bool)
+			for _, key := range keys {
+				if key != "" {
+					set[key] = true
+				}
+			}
+			mu.Lock()
+			for key := range set {
+				if held[key] {
+					t.Errorf("key [ %s ] held twice", key)
+				}
+				held[key] = true
+			}
+			mu.Unlock()
+			runtime.Gosched()
+			mu.Lock()
+			for key := range set {
+				held[key] = false
+			}
+			mu.Unlock()
+		}(sets[i%len(sets)])
+	}
+	wg.Wait()
+	if len(k.locks) != 0 {
+		t.Errorf("locks left after release: %v", k.locks)
+	}
+}
+
+const stressWorkers = 200
+
+func testNetworkID(prefix string, i int) string {
+	id := fmt.Sprintf("%s%04d", prefix, i)
+	return id + strings.Repeat("0", 64-len(id))
+}
+
+// testDriver returns a driver whose docker daemon has no networks. The
+// daemon listens on a unix socket, a test netns may have no loopback.
+func testDriver(t testing.TB) (*Driver, func()) {
+	dir, err := ioutil.TempDir("", "macvlan-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	srv := &httptest.Server{
+		Listener: listener,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("[]"))
+		})},
+	}
+	srv.Start()
+	stop := func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+	client, err := dockerclient.NewDockerClient("unix://"+sock, nil)
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	d := &Driver{
+		networks: networkTable{},
+		stop:     make(chan struct{}),
+		dockerer: dockerer{client: client},
+	}
+	if err := d.setupScope(scopeLocal, ""); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	return d, stop
+}
+
+func createTestNetwork(d *Driver, id, parent string, opts ...string) error {
+	generic := map[string]interface{}{optHostIface: parent}
+	for i := 0; i+1 < len(opts); i += 2 {
+		generic[opts[i]] = opts[i+1]
+	}
+	return d.CreateNetwork(&sdk.CreateNetworkRequest{
+		NetworkID: id,
+		Options:   map[string]interface{}{genericOptions: generic},
+		IPv4Data: []*sdk.IPAMData{{
+			Pool:    "10.0.0.0/8",
+			Gateway: "10.0.0.1/8",
+		}},
+	})
+}
+
+// endpointLifecycle runs the calls libnetwork makes for a container
+// connected to a network and removed again
+func endpointLifecycle(d *Driver, nid string, i int) error {
+	eid := testNetworkID("e", i)
+	ip := fmt.Sprintf("10.1.%d.%d/8", i/250, i%250+2)
+	if _, err := d.CreateEndpoint(&sdk.CreateEndpointRequest{
+		NetworkID:  nid,
+		EndpointID: eid,
+		Interface:  &sdk.EndpointInterface{Address: ip, MacAddress: fmt.Sprintf("7a:42:00:00:%02x:%02x", i/256, i%256)},
+	}); err != nil {
+		return fmt.Errorf("CreateEndpoint: %s", err)
+	}
+	if _, err := d.Join(&sdk.JoinRequest{NetworkID: nid, EndpointID: eid, SandboxKey: "/var/run/docker/netns/" + eid[:12]}); err != nil {
+		return fmt.Errorf("Join: %s", err)
+	}
+	if _, err := d.EndpointInfo(&sdk.InfoRequest{NetworkID: nid, EndpointID: eid}); err != nil {
+		return fmt.Errorf("EndpointInfo: %s", err)
+	}
+	if err := d.Leave(&sdk.LeaveRequest{NetworkID: nid, EndpointID: eid}); err != nil {
+		return fmt.Errorf("Leave: %s", err)
+	}
+	if err := d.DeleteEndpoint(&sdk.DeleteEndpointRequest{NetworkID: nid, EndpointID: eid}); err != nil {
+		return fmt.Errorf("DeleteEndpoint: %s", err)
+	}
+	return nil
+}
+
+// TestDriverStress runs hundreds of parallel driver calls against the fake
+// link layer, run with -race to check the driver state and host link
+// changes are serialized
+func TestDriverStress(t *testing.T) {
+	parents := []string{"fake0", "fake1", "fake2", "fake3"}
+	links, restore := useFakeLinks(parents...)
+	defer restore()
+	d, stop := testDriver(t)
+	defer stop()
+
+	// long lived networks shared by the workers
+	var shared []string
+	for i := 0; i < 8; i++ {
+		shared = append(shared, testNetworkID("s", i))
+	}
+	errs := make(chan error, 4*stressWorkers)
+	var wg sync.WaitGroup
+	for i, id := range shared {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			if err := createTestNetwork(d, id, parents[i%len(parents)]); err != nil {
+				errs <- fmt.Errorf("CreateNetwork: %s", err)
+			}
+		}(i, id)
+	}
+	wg.Wait()
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for _, parent := range parents {
+		readers.Add(1)
+		go func(parent string) {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				d.parentHealth(parent)
+				for _, n := range d.getNetworks() {
+					n.getEndpoints()
+				}
+			}
+		}(parent)
+	}
+	for i := 0; i < stressWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				if err := endpointLifecycle(d, shared[i%len(shared)], i); err != nil {
+					errs <- err
+				}
+				return
+			}
+			// a network of its own on a parent shared with the others
+			nid := testNetworkID("n", i)
+			if err := createTestNetwork(d, nid, parents[i%len(parents)]); err != nil {
+				errs <- fmt.Errorf("CreateNetwork: %s", err)
+				return
+			}
+			if err := endpointLifecycle(d, nid, i); err != nil {
+				errs <- err
+			}
+			if err := d.DeleteNetwork(&sdk.DeleteNetworkRequest{NetworkID: nid}); err != nil {
+				errs <- fmt.Errorf("DeleteNetwork: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, id := range shared {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := d.DeleteNetwork(&sdk.DeleteNetworkRequest{NetworkID: id}); err != nil {
+				errs <- fmt.Errorf("DeleteNetwork: %s", err)
+			}
+		}(id)
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := len(d.getNetworks()); n != 0 {
+		t.Errorf("%d networks left after deleting them all", n)
+	}
+	if names := links.names(); !reflect.DeepEqual(names, parents) {
+		t.Errorf("links left on the host: %v", names)
+	}
+}
+
+// TestJoinSameParent checks parallel joins on one parent each leave a
+// configured link and never collide on their names
+func TestJoinSameParent(t *testing.T) {
+	links, restore := useFakeLinks("fake0")
+	defer restore()
+	d, stop := testDriver(t)
+	defer stop()
+	nid := testNetworkID("j", 0)
+	if err := createTestNetwork(d, nid, "fake0"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, stressWorkers)
+	for i := 0; i < stressWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			eid := testNetworkID("e", i)
+			if _, err := d.CreateEndpoint(&sdk.CreateEndpointRequest{
+				NetworkID:  nid,
+				EndpointID: eid,
+				Interface:  &sdk.EndpointInterface{Address: fmt.Sprintf("10.1.%d.%d/8", i/250, i%250+2)},
+			}); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := d.Join(&sdk.JoinRequest{NetworkID: nid, EndpointID: eid, SandboxKey: "/nonexistent"}); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	parent, _ := linkOps.LinkByName("fake0")
+	joined := 0
+	all, _ := links.LinkList()
+	for _, l := range all {
+		if l.Attrs().ParentIndex == parent.Attrs().Index {
+			joined++
+			if l.Attrs().Flags&net.FlagUp == 0 || l.Attrs().MTU != defaultMTU {
+				t.Errorf("link [ %s ] wasn't configured: %+v", l.Attrs().Name, l.Attrs())
+			}
+		}
+	}
+	if joined != stressWorkers {
+		t.Errorf("%d links on the parent, expected %d", joined, stressWorkers)
+	}
+}
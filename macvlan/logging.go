@@ -0,0 +1,71 @@
+package macvlan
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// callLog is the log entry of one driver call. dockerd requests carry no ID
+// so each call gets a correlation ID tying its lines together.
+type callLog struct {
+	*log.Entry
+	start time.Time
+}
+
+// newCallLog returns the entry of a driver call, IDs the call doesn't have are left out
+func newCallLog(call, networkID, endpointID, sandbox string) *callLog {
+	fields := log.Fields{
+		"call":           call,
+		"correlation_id": correlationID(),
+	}
+	for k, v := range map[string]string{"network_id": networkID, "endpoint_id": endpointID, "sandbox": sandbox} {
+		if v != "" {
+			fields[k] = v
+		}
+	}
+	return &callLog{Entry: log.WithFields(fields), start: time.Now()}
+}
+
+// end logs the outcome of the call, failures at error level with their cause
+func (l *callLog) end(err *error) {
+	e := l.WithField("duration", time.Since(l.start).String())
+	if *err != nil {
+		e.WithField("cause", (*err).Error()).Errorf("%s failed", l.Data["call"])
+		return
+	}
+	e.Debugf("%s completed", l.Data["call"])
+}
+
+// with returns the entry of the call for changes it makes on behalf of
+// another network or endpoint, such as restoring an existing network
+func (l *callLog) with(networkID, endpointID string) *callLog {
+	fields := log.Fields{}
+	for k, v := range l.Data {
+		if k != "endpoint_id" && k != "sandbox" {
+			fields[k] = v
+		}
+	}
+	fields["network_id"] = networkID
+	if endpointID != "" {
+		fields["endpoint_id"] = endpointID
+	}
+	return &callLog{Entry: log.WithFields(fields), start: l.start}
+}
+
+func correlationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// endpointSandbox returns the sandbox an endpoint joined, if the driver knows it
+func (d *Driver) endpointSandbox(nid, eid string) string {
+	n, err := d.getNetwork(nid)
+	if err != nil {
+		return ""
+	}
+	return n.sandbox(eid)
+}
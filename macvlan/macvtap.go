@@ -0,0 +1,105 @@
+package macvlan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	linkTypeMacvlan = "macvlan"
+	linkTypeMacvtap = "macvtap"
+
+	infoTapDevice = "tap_device"
+	infoTapMajor  = "tap_major"
+	infoTapMinor  = "tap_minor"
+)
+
+// tapDevice is the character device of a macvtap endpoint, the container
+// creates its own /dev node from the major and minor numbers
+type tapDevice struct {
+	name  string
+	major uint32
+	minor uint32
+}
+
+// parseLinkType validates the -o link_type option, macvlan is the default
+func parseLinkType(opts map[string]string) (string, error) {
+	switch lt := opts[optLinkType]; lt {
+	case "", linkTypeMacvlan:
+		return linkTypeMacvlan, nil
+	case linkTypeMacvtap:
+		return lt, nil
+	default:
+		return "", fmt.Errorf("invalid -o %s=%s, expected %s or %s", optLinkType, lt, linkTypeMacvlan, linkTypeMacvtap)
+	}
+}
+
+// addMacvtap creates a macvtap link for linkOps.LinkAdd. The vendored netlink
+// LinkAdd only sends the mode of *Macvlan links so macvtap links would always
+// get the kernel default vepa mode.
+func addMacvtap(macvtap *netlink.Macvtap) error {
+	modes := map[netlink.MacvlanMode]uint32{
+		netlink.MACVLAN_MODE_PRIVATE:  nl.MACVLAN_MODE_PRIVATE,
+		netlink.MACVLAN_MODE_VEPA:     nl.MACVLAN_MODE_VEPA,
+		netlink.MACVLAN_MODE_BRIDGE:   nl.MACVLAN_MODE_BRIDGE,
+		netlink.MACVLAN_MODE_PASSTHRU: nl.MACVLAN_MODE_PASSTHRU,
+	}
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(syscall.AF_UNSPEC))
+	req.AddData(nl.NewRtAttr(syscall.IFLA_LINK, nl.Uint32Attr(uint32(macvtap.ParentIndex))))
+	req.AddData(nl.NewRtAttr(syscall.IFLA_IFNAME, nl.ZeroTerminated(macvtap.Name)))
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated(macvtap.Type()))
+	if mode, ok := modes[macvtap.Mode]; ok {
+		data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+		nl.NewRtAttrChild(data, nl.IFLA_MACVLAN_MODE, nl.Uint32Attr(mode))
+	}
+	req.AddData(linkInfo)
+	if _, err := req.Execute(syscall.NETLINK_ROUTE, 0); err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(macvtap.Name)
+	if err != nil {
+		return err
+	}
+	macvtap.Index = link.Attrs().Index
+	return nil
+}
+
+// macvtapDevice reads the character device of a macvtap link from sysfs.
+// It has to be read in the host netns before the link is moved.
+func macvtapDevice(link netlink.Link) (*tapDevice, error) {
+	name := fmt.Sprintf("tap%d", link.Attrs().Index)
+	b, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/macvtap/%s/dev", link.Attrs().Name, name))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the macvtap device of [ %s ]: %s", link.Attrs().Name, err)
+	}
+	nums := strings.SplitN(strings.TrimSpace(string(b)), ":", 2)
+	if len(nums) != 2 {
+		return nil, fmt.Errorf("invalid macvtap device number [ %s ] for [ %s ]", strings.TrimSpace(string(b)), link.Attrs().Name)
+	}
+	major, err := strconv.ParseUint(nums[0], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	minor, err := strconv.ParseUint(nums[1], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &tapDevice{name: name, major: uint32(major), minor: uint32(minor)}, nil
+}
+
+// info returns the device as reported by EndpointInfo
+func (tap *tapDevice) info() map[string]string {
+	return map[string]string{
+		infoTapDevice: "/dev/" + tap.name,
+		infoTapMajor:  strconv.FormatUint(uint64(tap.major), 10),
+		infoTapMinor:  strconv.FormatUint(uint64(tap.minor), 10),
+	}
+}
@@ -0,0 +1,85 @@
+package macvlan
+
+import (
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// linkLayer is the netlink link API the driver uses to find and change
+// links. Calls made inside a sandbox go to the netns of the calling thread.
+type linkLayer interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkByIndex(index int) (netlink.Link, error)
+	LinkList() ([]netlink.Link, error)
+	LinkAdd(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+	LinkSetUp(link netlink.Link) error
+	LinkSetDown(link netlink.Link) error
+	LinkSetMTU(link netlink.Link, mtu int) error
+	LinkSetName(link netlink.Link, name string) error
+	LinkSetAlias(link netlink.Link, alias string) error
+	LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error
+	LinkSetMasterByIndex(link netlink.Link, masterIndex int) error
+	LinkSetNoMaster(link netlink.Link) error
+}
+
+// linkOps is the kernel netlink, tests swap in a fake
+var linkOps linkLayer = netlinkLinks{}
+
+type netlinkLinks struct{}
+
+func (netlinkLinks) LinkByName(name string) (netlink.Link, error) {
+	return netlink.LinkByName(name)
+}
+
+func (netlinkLinks) LinkByIndex(index int) (netlink.Link, error) {
+	return netlink.LinkByIndex(index)
+}
+
+func (netlinkLinks) LinkList() ([]netlink.Link, error) {
+	return netlink.LinkList()
+}
+
+func (netlinkLinks) LinkAdd(link netlink.Link) error {
+	if macvtap, ok := link.(*netlink.Macvtap); ok {
+		return addMacvtap(macvtap)
+	}
+	return netlink.LinkAdd(link)
+}
+
+func (netlinkLinks) LinkDel(link netlink.Link) error {
+	return netlink.LinkDel(link)
+}
+
+func (netlinkLinks) LinkSetUp(link netlink.Link) error {
+	return netlink.LinkSetUp(link)
+}
+
+func (netlinkLinks) LinkSetDown(link netlink.Link) error {
+	return netlink.LinkSetDown(link)
+}
+
+func (netlinkLinks) LinkSetMTU(link netlink.Link, mtu int) error {
+	return netlink.LinkSetMTU(link, mtu)
+}
+
+func (netlinkLinks) LinkSetName(link netlink.Link, name string) error {
+	return netlink.LinkSetName(link, name)
+}
+
+func (netlinkLinks) LinkSetAlias(link netlink.Link, alias string) error {
+	return netlink.LinkSetAlias(link, alias)
+}
+
+func (netlinkLinks) LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error {
+	return netlink.LinkSetHardwareAddr(link, hwaddr)
+}
+
+func (netlinkLinks) LinkSetMasterByIndex(link netlink.Link, masterIndex int) error {
+	return netlink.LinkSetMasterByIndex(link, masterIndex)
+}
+
+func (netlinkLinks) LinkSetNoMaster(link netlink.Link) error {
+	return netlink.LinkSetNoMaster(link)
+}
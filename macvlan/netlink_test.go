@@ -0,0 +1,211 @@
+package macvlan
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// fakeLinks is an in-memory linkLayer. Each call is atomic like a netlink
+// request, sequences of calls are only serialized by the driver locks.
+type fakeLinks struct {
+	sync.Mutex
+	links map[int]netlink.Link
+	next  int
+}
+
+// useFakeLinks swaps linkOps for a fake holding the parents and returns the
+// function restoring the kernel netlink
+func useFakeLinks(parents ...string) (*fakeLinks, func()) {
+	f := &fakeLinks{links: make(map[int]netlink.Link)}
+	for _, name := range parents {
+		f.LinkAdd(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: defaultMTU, Flags: net.FlagUp}})
+	}
+	linkOps = f
+	return f, func() { linkOps = netlinkLinks{} }
+}
+
+// copyLink returns a copy callers can't share with the fake or each other
+func copyLink(link netlink.Link) netlink.Link {
+	switch l := link.(type) {
+	case *netlink.Macvlan:
+		c := *l
+		return &c
+	case *netlink.Macvtap:
+		c := *l
+		return &c
+	case *netlink.Vxlan:
+		c := *l
+		return &c
+	case *netlink.Device:
+		c := *l
+		return &c
+	}
+	return &netlink.Device{LinkAttrs: *link.Attrs()}
+}
+
+// find returns the stored link by index, or by name for links created
+// without one. Callers hold the lock.
+func (f *fakeLinks) find(link netlink.Link) (netlink.Link, error) {
+	attrs := link.Attrs()
+	if attrs.Index != 0 {
+		if l, ok := f.links[attrs.Index]; ok {
+			return l, nil
+		}
+		return nil, syscall.ENODEV
+	}
+	for _, l := range f.links {
+		if l.Attrs().Name == attrs.Name {
+			return l, nil
+		}
+	}
+	return nil, syscall.ENODEV
+}
+
+func (f *fakeLinks) update(link netlink.Link, fn func(*netlink.LinkAttrs) error) error {
+	f.Lock()
+	defer f.Unlock()
+	l, err := f.find(link)
+	if err != nil {
+		return err
+	}
+	return fn(l.Attrs())
+}
+
+// names returns the sorted link names
+func (f *fakeLinks) names() []string {
+	f.Lock()
+	defer f.Unlock()
+	var names []string
+	for _, l := range f.links {
+		names = append(names, l.Attrs().Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *fakeLinks) LinkByName(name string) (netlink.Link, error) {
+	f.Lock()
+	defer f.Unlock()
+	l, err := f.find(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: name}})
+	if err != nil {
+		return nil, fmt.Errorf("Link not found")
+	}
+	return copyLink(l), nil
+}
+
+func (f *fakeLinks) LinkByIndex(index int) (netlink.Link, error) {
+	f.Lock()
+	defer f.Unlock()
+	l, ok := f.links[index]
+	if !ok {
+		return nil, fmt.Errorf("Link not found")
+	}
+	return copyLink(l), nil
+}
+
+func (f *fakeLinks) LinkList() ([]netlink.Link, error) {
+	f.Lock()
+	defer f.Unlock()
+	links := make([]netlink.Link, 0, len(f.links))
+	for _, l := range f.links {
+		links = append(links, copyLink(l))
+	}
+	return links, nil
+}
+
+func (f *fakeLinks) LinkAdd(link netlink.Link) error {
+	f.Lock()
+	defer f.Unlock()
+	attrs := link.Attrs()
+	if _, err := f.find(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: attrs.Name}}); err == nil {
+		return syscall.EEXIST
+	}
+	if attrs.ParentIndex != 0 {
+		if _, ok := f.links[attrs.ParentIndex]; !ok {
+			return syscall.ENODEV
+		}
+	}
+	f.next++
+	attrs.Index = f.next
+	f.links[f.next] = copyLink(link)
+	return nil
+}
+
+func (f *fakeLinks) LinkDel(link netlink.Link) error {
+	f.Lock()
+	defer f.Unlock()
+	l, err := f.find(link)
+	if err != nil {
+		return err
+	}
+	delete(f.links, l.Attrs().Index)
+	return nil
+}
+
+func (f *fakeLinks) LinkSetUp(link netlink.Link) error {
+	return f.update(link, func(a *netlink.LinkAttrs) error {
+		a.Flags |= net.FlagUp
+		return nil
+	})
+}
+
+func (f *fakeLinks) LinkSetDown(link netlink.Link) error {
+	return f.update(link, func(a *netlink.LinkAttrs) error {
+		a.Flags &^= net.FlagUp
+		return nil
+	})
+}
+
+func (f *fakeLinks) LinkSetMTU(link netlink.Link, mtu int) error {
+	return f.update(link, func(a *netlink.LinkAttrs) error {
+		a.MTU = mtu
+		return nil
+	})
+}
+
+func (f *fakeLinks) LinkSetName(link netlink.Link, name string) error {
+	f.Lock()
+	defer f.Unlock()
+	l, err := f.find(link)
+	if err != nil {
+		return err
+	}
+	if other, err := f.find(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: name}}); err == nil && other != l {
+		return syscall.EEXIST
+	}
+	l.Attrs().Name = name
+	return nil
+}
+
+func (f *fakeLinks) LinkSetAlias(link netlink.Link, alias string) error {
+	return f.update(link, func(a *netlink.LinkAttrs) error {
+		a.Alias = alias
+		return nil
+	})
+}
+
+func (f *fakeLinks) LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error {
+	return f.update(link, func(a *netlink.LinkAttrs) error {
+		a.HardwareAddr = hwaddr
+		return nil
+	})
+}
+
+func (f *fakeLinks) LinkSetMasterByIndex(link netlink.Link, masterIndex int) error {
+	return f.update(link, func(a *netlink.LinkAttrs) error {
+		a.MasterIndex = masterIndex
+		return nil
+	})
+}
+
+func (f *fakeLinks) LinkSetNoMaster(link netlink.Link) error {
+	return f.update(link, func(a *netlink.LinkAttrs) error {
+		a.MasterIndex = 0
+		return nil
+	})
+}
@@ -0,0 +1,113 @@
+package macvlan
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// genericOptions is the libnetwork label -o and --driver-opt values are nested under
+	genericOptions = "com.docker.network.generic"
+
+	optHostIface         = "host_iface"
+	optEgressRate        = "egress_rate"
+	optEgressBurst       = "egress_burst"
+	optNoGateway         = "no_gateway"
+	optKeepDockerGateway = "keep_docker_gateway"
+	optRoutes            = "routes"
+	optAntiSpoof         = "anti_spoof"
+	optLinkType          = "link_type"
+	optMode              = "mode"
+)
+
+// parseOptions flattens the driver options sent by libnetwork. Options can
+// be top level string values or nested under the generic data label.
+func parseOptions(opts map[string]interface{}) map[string]string {
+	parsed := make(map[string]string)
+	for k, v := range opts {
+		switch val := v.(type) {
+		case string:
+			parsed[k] = val
+		case map[string]interface{}:
+			if k != genericOptions {
+				continue
+			}
+			for key, gv := range val {
+				if s, ok := gv.(string); ok {
+					parsed[key] = s
+				}
+			}
+		case map[string]string:
+			if k != genericOptions {
+				continue
+			}
+			for key, s := range val {
+				parsed[key] = s
+			}
+		}
+	}
+	return parsed
+}
+
+// parseBoolOption returns false for unset options and an error for invalid values
+func parseBoolOption(opts map[string]string, key string) (bool, error) {
+	v, ok := opts[key]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid -o %s=%s, expected true or false", key, v)
+	}
+	return b, nil
+}
+
+// parseRate parses a tc style rate into bytes per second. Bit rates use the
+// bit, kbit, mbit, gbit suffixes and byte rates the bps, kbps, mbps, gbps suffixes.
+func parseRate(s string) (uint64, error) {
+	units := []struct {
+		suffix string
+		bytes  float64
+	}{
+		{"gbps", 1e9}, {"mbps", 1e6}, {"kbps", 1e3}, {"bps", 1},
+		{"gbit", 1e9 / 8}, {"mbit", 1e6 / 8}, {"kbit", 1e3 / 8}, {"bit", 1.0 / 8},
+	}
+	lower := strings.ToLower(strings.TrimSpace(s))
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			val, err := strconv.ParseFloat(strings.TrimSuffix(lower, u.suffix), 64)
+			if err != nil || val <= 0 {
+				return 0, fmt.Errorf("invalid rate [ %s ]", s)
+			}
+			// tbf rates are whole bytes per second
+			if val*u.bytes < 1 {
+				return 0, fmt.Errorf("invalid rate [ %s ], the minimum is 8bit", s)
+			}
+			return uint64(val * u.bytes), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid rate [ %s ], a unit is required. Example: 100mbit", s)
+}
+
+// parseSize parses a size in bytes with an optional k, m or g suffix
+func parseSize(s string) (uint64, error) {
+	lower := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "b")
+	mult := uint64(1)
+	switch {
+	case strings.HasSuffix(lower, "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(lower, "m"):
+		mult = 1 << 20
+	case strings.HasSuffix(lower, "g"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		lower = lower[:len(lower)-1]
+	}
+	val, err := strconv.ParseUint(lower, 10, 64)
+	if err != nil || val == 0 {
+		return 0, fmt.Errorf("invalid size [ %s ]", s)
+	}
+	return val * mult, nil
+}
@@ -0,0 +1,81 @@
+package macvlan
+
+import "testing"
+
+func TestParseBoolOption(t *testing.T) {
+	tests := []struct {
+		opts    map[string]string
+		want    bool
+		wantErr bool
+	}{
+		{opts: map[string]string{}, want: false},
+		{opts: map[string]string{optNoGateway: "true"}, want: true},
+		{opts: map[string]string{optNoGateway: "1"}, want: true},
+		{opts: map[string]string{optNoGateway: "false"}, want: false},
+		{opts: map[string]string{optNoGateway: ""}, wantErr: true},
+		{opts: map[string]string{optNoGateway: "yes"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseBoolOption(tt.opts, optNoGateway)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseBoolOption(%v) error = %v, wantErr %v", tt.opts, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseBoolOption(%v) = %v, want %v", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestSetOptionsGatewayModes(t *testing.T) {
+	tests := []struct {
+		opts    map[string]string
+		wantErr bool
+		gateway string
+		disable bool
+	}{
+		{opts: map[string]string{}, gateway: "192.168.1.1", disable: true},
+		{opts: map[string]string{optNoGateway: "true"}, gateway: "", disable: true},
+		{opts: map[string]string{optKeepDockerGateway: "true"}, gateway: "", disable: false},
+		{opts: map[string]string{optNoGateway: "false", optKeepDockerGateway: "false"}, gateway: "192.168.1.1", disable: true},
+		{opts: map[string]string{optNoGateway: "true", optKeepDockerGateway: "true"}, wantErr: true},
+		{opts: map[string]string{optKeepDockerGateway: "maybe"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		n := &network{gateway: "192.168.1.1"}
+		tt.opts[optHostIface] = "eth1"
+		err := n.setOptions(tt.opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("setOptions(%v) error = %v, wantErr %v", tt.opts, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		gateway, disable := n.joinGateway()
+		if gateway != tt.gateway || disable != tt.disable {
+			t.Errorf("setOptions(%v) joins with gateway %q, DisableGatewayService %v, want %q, %v",
+				tt.opts, gateway, disable, tt.gateway, tt.disable)
+		}
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	opts := parseOptions(map[string]interface{}{
+		optHostIface: "eth1",
+		genericOptions: map[string]interface{}{
+			optNoGateway: "true",
+			"ignored":    1,
+		},
+		"other.label": map[string]interface{}{optKeepDockerGateway: "true"},
+	})
+	if opts[optHostIface] != "eth1" || opts[optNoGateway] != "true" {
+		t.Errorf("parseOptions lost an option: %v", opts)
+	}
+	if _, ok := opts[optKeepDockerGateway]; ok {
+		t.Errorf("parseOptions read an option outside the generic label: %v", opts)
+	}
+	if _, ok := opts["ignored"]; ok {
+		t.Errorf("parseOptions kept a non string option: %v", opts)
+	}
+}
@@ -0,0 +1,215 @@
+package macvlan
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	optRouteTable = "route_table"
+	optShimIface  = "shim_iface"
+
+	// policyRulePriority places the network rules before the main table rule at 32766
+	policyRulePriority = 1000
+	// tables 253 to 255 are the kernel default, main and local tables
+	minReservedTable = 253
+	maxReservedTable = 255
+)
+
+// parseRouteTable reads the -o route_table option, 0 when unset
+func parseRouteTable(opts map[string]string) (int, error) {
+	v, ok := opts[optRouteTable]
+	if !ok {
+		return 0, nil
+	}
+	table, err := strconv.ParseUint(v, 10, 32)
+	if err != nil || table == 0 || (table >= minReservedTable && table <= maxReservedTable) {
+		return 0, fmt.Errorf("invalid -o %s=%s, expected a table id other than 0 and %d-%d", optRouteTable, v, minReservedTable, maxReservedTable)
+	}
+	return int(table), nil
+}
+
+// policyLink is the host link the network table routes through, the host
+// shim when there is one since the parent can't reach its macvlan children
+func (n *network) policyLink() (netlink.Link, error) {
+	name := n.ifaceOpt
+	if n.shimIface != "" {
+		name = n.shimIface
+	}
+	link, err := linkOps.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find the -o %s link [ %s ]: %s", optRouteTable, name, err)
+	}
+	return link, nil
+}
+
+// policyRoutes returns the subnet and gateway routes of the network table
+func (n *network) policyRoutes(link netlink.Link) []*netlink.Route {
+	var routes []*netlink.Route
+	for _, subnet := range []*net.IPNet{n.cidr, n.cidr6} {
+		if subnet == nil {
+			continue
+		}
+		routes = append(routes, &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       subnet,
+			Scope:     netlink.SCOPE_LINK,
+			Table:     n.routeTable,
+		})
+	}
+	if gw := net.ParseIP(n.gateway); gw != nil && !n.noGateway {
+		routes = append(routes, &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Gw:        gw,
+			Table:     n.routeTable,
+		})
+	}
+	return routes
+}
+
+// policyRules returns the rules sending traffic sourced from the network
+// subnets, including the host shim, to the network table. VRFs have their
+// own l3mdev rule.
+func (n *network) policyRules() []*netlink.Rule {
+	var rules []*netlink.Rule
+	if n.vrf != "" {
+		return nil
+	}
+	for _, subnet := range []*net.IPNet{n.cidr, n.cidr6} {
+		if subnet == nil {
+			continue
+		}
+		rule := netlink.NewRule()
+		rule.Src = subnet
+		rule.Table = n.routeTable
+		rule.Priority = policyRulePriority
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// setupPolicyRouting fills the -o route_table table of the network and adds
+// its rules. undo deletes the routes and rules the call added.
+func (n *network) setupPolicyRouting(l *callLog) (undo func(), err error) {
+	if n.routeTable == 0 {
+		return nil, nil
+	}
+	link, err := n.policyLink()
+	if err != nil {
+		return nil, err
+	}
+	var routes []*netlink.Route
+	var rules []*netlink.Rule
+	undo = func() {
+		for _, rule := range rules {
+			if err := l.audit(auditRuleDel, ruleTarget(rule), tableDetail(rule.Table), ruleDel(rule)); err != nil && err != syscall.ENOENT {
+				log.Warnf("Unable to delete rule [ %s ]: %s", rule, err)
+			}
+		}
+		for _, route := range routes {
+			if err := l.audit(auditRouteDel, routeTarget(route), tableDetail(n.routeTable), netlink.RouteDel(route)); err != nil && err != syscall.ESRCH {
+				log.Warnf("Unable to delete route [ %s ] from table [ %d ]: %s", route, n.routeTable, err)
+			}
+		}
+	}
+	// shim routes use the address the shim has on the network subnet as source
+	var src net.IP
+	if n.shimIface != "" && n.cidr != nil {
+		addrs, _ := netlink.AddrList(link, netlink.FAMILY_V4)
+		for _, a := range addrs {
+			if n.cidr.Contains(a.IP) {
+				src = a.IP
+			}
+		}
+	}
+	for _, route := range n.policyRoutes(link) {
+		if route.Dst != nil && route.Dst.IP.To4() != nil {
+			route.Src = src
+		}
+		err := l.audit(auditRouteAdd, routeTarget(route), tableDetail(n.routeTable), netlink.RouteAdd(route))
+		if err == nil {
+			routes = append(routes, route)
+		} else if err != syscall.EEXIST {
+			return undo, fmt.Errorf("unable to add route [ %s ] to table [ %d ]: %s", route, n.routeTable, err)
+		}
+	}
+	for _, rule := range n.policyRules() {
+		err := l.audit(auditRuleAdd, ruleTarget(rule), tableDetail(rule.Table), netlink.RuleAdd(rule))
+		if err == nil {
+			rules = append(rules, rule)
+		} else if err != syscall.EEXIST {
+			return undo, fmt.Errorf("unable to add rule [ %s ]: %s", rule, err)
+		}
+	}
+	log.Infof("Network [ %s ] routes through table [ %d ] on [ %s ]", n.id, n.routeTable, link.Attrs().Name)
+	return undo, nil
+}
+
+// deletePolicyRouting removes the network rules and its routes from the
+// table. Routes other than the network ones are left, the table can be
+// shared with a VRF or hold routes the operator added.
+func (n *network) deletePolicyRouting(l *callLog) {
+	if n.routeTable == 0 {
+		return
+	}
+	for _, rule := range n.policyRules() {
+		if err := l.audit(auditRuleDel, ruleTarget(rule), tableDetail(rule.Table), ruleDel(rule)); err != nil && err != syscall.ENOENT {
+			log.Warnf("Unable to delete rule [ %s ]: %s", rule, err)
+		}
+	}
+	// routes through a link that is gone were removed along with it
+	if link, err := n.policyLink(); err == nil {
+		for _, route := range n.policyRoutes(link) {
+			if err := l.audit(auditRouteDel, routeTarget(route), tableDetail(n.routeTable), netlink.RouteDel(route)); err != nil && err != syscall.ESRCH {
+				log.Warnf("Unable to delete route [ %s ] from table [ %d ]: %s", route, n.routeTable, err)
+			}
+		}
+	}
+	log.Infof("Removed the routes and rules of network [ %s ] from table [ %d ]", n.id, n.routeTable)
+}
+
+// ruleDel deletes a source rule. The vendored netlink RuleDel sends
+// NLM_F_EXCL, which newer kernels read as NLM_F_BULK on deletes and
+// reject with EOPNOTSUPP.
+func ruleDel(rule *netlink.Rule) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_DELRULE, syscall.NLM_F_ACK)
+	msg := nl.NewRtMsg()
+	src := rule.Src.IP.To4()
+	msg.Family = syscall.AF_INET
+	if src == nil {
+		src = rule.Src.IP.To16()
+		msg.Family = syscall.AF_INET6
+	}
+	srcLen, _ := rule.Src.Mask.Size()
+	msg.Src_len = uint8(srcLen)
+	msg.Table = syscall.RT_TABLE_UNSPEC
+	if rule.Table < 256 {
+		msg.Table = uint8(rule.Table)
+	}
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(syscall.RTA_SRC, src))
+	req.AddData(nl.NewRtAttr(nl.FRA_PRIORITY, nl.Uint32Attr(uint32(rule.Priority))))
+	req.AddData(nl.NewRtAttr(nl.FRA_TABLE, nl.Uint32Attr(uint32(rule.Table))))
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// checkRouteTable verifies a network table isn't already used by another
+// network outside its VRF
+func (d *Driver) checkRouteTable(n *network) error {
+	if n.routeTable == 0 {
+		return nil
+	}
+	for _, other := range d.getNetworks() {
+		if other.id != n.id && other.routeTable == n.routeTable && (n.vrf == "" || other.vrf != n.vrf) {
+			return fmt.Errorf("-o %s=%d is already used by network [ %s ]", optRouteTable, n.routeTable, other.id)
+		}
+	}
+	return nil
+}
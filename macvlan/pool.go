@@ -0,0 +1,260 @@
+package macvlan
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	optLinkPool = "link_pool"
+	maxLinkPool = 256
+
+	// pool links are named mvp-<network hash>-<n>, which the orphan cleanup
+	// of endpoint links never matches. The 6 hex digit hash of the network ID
+	// and the 4 hex digit sequence, wrapping at poolSeqLimit, keep the names
+	// within the 15 characters of IFNAMSIZ.
+	poolLinkPrefix = "mvp-"
+	poolSeqLimit   = 0x10000
+	// poolRetryInterval paces the refill after a link couldn't be created
+	poolRetryInterval = 5 * time.Second
+)
+
+// parseLinkPool reads the -o link_pool size, 0 when unset
+func parseLinkPool(opts map[string]string) (int, error) {
+	v, ok := opts[optLinkPool]
+	if !ok {
+		return 0, nil
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil || size < 0 || size > maxLinkPool {
+		return 0, fmt.Errorf("invalid -o %s=%s, expected 0 to %d links", optLinkPool, v, maxLinkPool)
+	}
+	return size, nil
+}
+
+// linkPool keeps down state macvlan links ready on a network parent so
+// Join only has to rename and bring one up. A worker refills it in the
+// background as links are claimed.
+type linkPool struct {
+	size   int
+	parent string
+	mode   netlink.MacvlanMode
+	prefix string
+	// network is the ID the refills are audited under
+	network string
+	seq     int
+	links   []string
+	sync.Mutex
+	refill chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// startPool starts the -o link_pool worker of a network, adopting the pool
+// links left on the parent by a previous run
+func (n *network) startPool(l *callLog) error {
+	if n.poolSize == 0 || n.linkType != linkTypeMacvlan || n.linkPool() != nil {
+		return nil
+	}
+	mode, err := setVlanMode(n.modeOpt)
+	if err != nil {
+		return err
+	}
+	p := &linkPool{
+		size:    n.poolSize,
+		parent:  n.ifaceOpt,
+		mode:    mode,
+		prefix:  poolPrefix(n.id),
+		network: n.id,
+		refill:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	p.adopt(l)
+	n.Lock()
+	n.pool = p
+	n.Unlock()
+	go p.run()
+	log.Infof("Network [ %s ] keeps [ %d ] macvlan links ready on [ %s ]", n.id, p.size, p.parent)
+	return nil
+}
+
+// poolPrefix returns the name prefix of the pool links of a network
+func poolPrefix(nid string) string {
+	h := fnv.New32a()
+	h.Write([]byte(nid))
+	return fmt.Sprintf("%s%06x-", poolLinkPrefix, h.Sum32()&0xffffff)
+}
+
+// stopPool stops the refill worker, deleting the pooled links when the
+// network goes away
+func (n *network) stopPool(l *callLog, deleteLinks bool) {
+	n.Lock()
+	p := n.pool
+	n.pool = nil
+	n.Unlock()
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	if !deleteLinks {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	for _, name := range p.links {
+		deleteHostLink(l, name)
+	}
+	p.links = nil
+}
+
+// adopt takes back the down pool links already on the parent
+func (p *linkPool) adopt(l *callLog) {
+	parent, err := linkOps.LinkByName(p.parent)
+	if err != nil {
+		return
+	}
+	links, err := linkOps.LinkList()
+	if err != nil {
+		return
+	}
+	for _, link := range links {
+		attrs := link.Attrs()
+		if link.Type() != "macvlan" || attrs.ParentIndex != parent.Attrs().Index || !strings.HasPrefix(attrs.Name, p.prefix) {
+			continue
+		}
+		if attrs.Flags&net.FlagUp != 0 || len(p.links) >= p.size {
+			l.audit(auditLinkDel, attrs.Name, "pool", linkOps.LinkDel(link))
+			continue
+		}
+		p.links = append(p.links, attrs.Name)
+	}
+}
+
+func (p *linkPool) run() {
+	defer close(p.done)
+	for {
+		retry := p.fill(newCallLog("LinkPool", p.network, "", ""))
+		var wait <-chan time.Time
+		if retry {
+			wait = time.After(poolRetryInterval)
+		}
+		select {
+		case <-p.refill:
+		case <-wait:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// fill creates links until the pool is full, returning true if it failed
+func (p *linkPool) fill(l *callLog) bool {
+	for {
+		select {
+		case <-p.stop:
+			return false
+		default:
+		}
+		p.Lock()
+		if len(p.links) >= p.size {
+			p.Unlock()
+			return false
+		}
+		p.seq = (p.seq + 1) % poolSeqLimit
+		name := fmt.Sprintf("%s%04x", p.prefix, p.seq)
+		p.Unlock()
+		err := p.create(l, name)
+		if err == syscall.EEXIST {
+			continue
+		}
+		if err != nil {
+			log.Warnf("Unable to add link [ %s ] to the pool of [ %s ]: %s", name, p.parent, err)
+			return true
+		}
+		p.Lock()
+		p.links = append(p.links, name)
+		p.Unlock()
+	}
+}
+
+// create adds a down state macvlan link with the MTU of Join links
+func (p *linkPool) create(l *callLog, name string) error {
+	parent, err := linkOps.LinkByName(p.parent)
+	if err != nil {
+		return err
+	}
+	mvlan := &netlink.Macvlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        name,
+			ParentIndex: parent.Attrs().Index,
+		},
+		Mode: p.mode,
+	}
+	if err := l.audit(auditLinkAdd, name, "pool macvlan on "+p.parent, linkOps.LinkAdd(mvlan)); err != nil {
+		return err
+	}
+	mtu := linkMTU(parent)
+	err = l.audit(auditLinkMTU, name, strconv.Itoa(mtu), linkOps.LinkSetMTU(mvlan, mtu))
+	if err == nil {
+		err = setLinkAlias(l, mvlan, endpointLinkAlias(p.network))
+	}
+	if err != nil {
+		l.audit(auditLinkDel, name, "pool", linkOps.LinkDel(mvlan))
+		return err
+	}
+	return nil
+}
+
+// requestRefill wakes the worker to replace the claimed links. Join requests
+// it once its link is set up, a refill running along the claim would slow
+// Join down with the netlink calls it serializes with in the kernel.
+func (p *linkPool) requestRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// claim renames a pooled link for an endpoint and sets its mac. It returns
+// nil when the pool is empty and the link has to be created inline.
+func (p *linkPool) claim(l *callLog, name string, mac net.HardwareAddr) netlink.Link {
+	p.Lock()
+	var pooled string
+	if len(p.links) > 0 {
+		pooled, p.links = p.links[0], p.links[1:]
+	}
+	p.Unlock()
+	if pooled == "" {
+		return nil
+	}
+	link, err := linkOps.LinkByName(pooled)
+	if err != nil {
+		log.Warnf("Pooled link [ %s ] is gone: %s", pooled, err)
+		return nil
+	}
+	err = l.audit(auditLinkName, pooled, name, linkOps.LinkSetName(link, name))
+	if err == nil && mac != nil {
+		err = l.audit(auditLinkMac, name, mac.String(), linkOps.LinkSetHardwareAddr(link, mac))
+	}
+	var claimed netlink.Link
+	if err == nil {
+		claimed, err = linkOps.LinkByName(name)
+	}
+	if err != nil {
+		log.Warnf("Unable to claim pooled link [ %s ] for [ %s ]: %s", pooled, name, err)
+		l.audit(auditLinkDel, link.Attrs().Name, "pool", linkOps.LinkDel(link))
+		return nil
+	}
+	return claimed
+}
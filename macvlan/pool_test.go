@@ -0,0 +1,132 @@
+package macvlan
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	sdk "github.com/docker/go-plugins-helpers/network"
+)
+
+// ifNameSize is IFNAMSIZ without the terminating nul
+const ifNameSize = 15
+
+// waitPoolFull waits for the worker to refill the pool of a network
+func waitPoolFull(t testing.TB, d *Driver, nid string) *linkPool {
+	p := d.network(nid).linkPool()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.Lock()
+		full := len(p.links) >= p.size
+		p.Unlock()
+		if full {
+			return p
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the pool of [ %s ] wasn't refilled", nid)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestPoolLinkNames checks pool link names fit IFNAMSIZ for any network ID
+// and sequence, and are claimed for Join
+func TestPoolLinkNames(t *testing.T) {
+	links, restore := useFakeLinks("fake0")
+	defer restore()
+	d, stop := testDriver(t)
+	defer stop()
+	// libnetwork IDs are 64 characters, the pool can't assume it
+	for j, nid := range []string{"n", testNetworkID("n", 1)} {
+		if err := createTestNetwork(d, nid, "fake0", optLinkPool, "4"); err != nil {
+			t.Fatal(err)
+		}
+		p := waitPoolFull(t, d, nid)
+		p.Lock()
+		p.seq = poolSeqLimit - 2
+		p.Unlock()
+		for i := 0; i < 4; i++ {
+			eid := testNetworkID(fmt.Sprintf("e%d", j), i)
+			if _, err := d.CreateEndpoint(&sdk.CreateEndpointRequest{
+				NetworkID:  nid,
+				EndpointID: eid,
+				Interface:  &sdk.EndpointInterface{Address: fmt.Sprintf("10.1.%d.%d/8", j, i+2)},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := d.Join(&sdk.JoinRequest{NetworkID: nid, EndpointID: eid, SandboxKey: "/nonexistent"}); err != nil {
+				t.Fatal(err)
+			}
+			waitPoolFull(t, d, nid)
+		}
+		p.Lock()
+		if p.seq >= 4 {
+			t.Errorf("the pool sequence of [ %s ] didn't wrap: %d", nid, p.seq)
+		}
+		p.Unlock()
+	}
+	var pooled int
+	for _, name := range links.names() {
+		if len(name) > ifNameSize {
+			t.Errorf("link name [ %s ] is longer than %d characters", name, ifNameSize)
+		}
+		if strings.HasPrefix(name, poolLinkPrefix) {
+			pooled++
+		}
+	}
+	if pooled != 8 {
+		t.Errorf("%d pool links, expected 8: %v", pooled, links.names())
+	}
+}
+
+// BenchmarkJoinCold and BenchmarkJoinWarm compare Join creating the link
+// with Join claiming it from a warm -o link_pool. They need root and a parent
+// in a netns of its own:
+//
+//	ip netns exec <netns> env MACVLAN_BENCH_PARENT=<parent> go test -run - -bench Join ./macvlan/
+func BenchmarkJoinCold(b *testing.B) {
+	benchmarkJoin(b, "0")
+}
+
+func BenchmarkJoinWarm(b *testing.B) {
+	benchmarkJoin(b, "8")
+}
+
+func benchmarkJoin(b *testing.B, pool string) {
+	parent := os.Getenv("MACVLAN_BENCH_PARENT")
+	if parent == "" || os.Geteuid() != 0 {
+		b.Skip("needs root and MACVLAN_BENCH_PARENT set to a parent interface")
+	}
+	d, stop := testDriver(b)
+	defer stop()
+	nid := testNetworkID("bench", 0)
+	if err := createTestNetwork(d, nid, parent, optLinkPool, pool); err != nil {
+		b.Fatal(err)
+	}
+	defer d.DeleteNetwork(&sdk.DeleteNetworkRequest{NetworkID: nid})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		eid := testNetworkID("b", i)
+		if _, err := d.CreateEndpoint(&sdk.CreateEndpointRequest{
+			NetworkID:  nid,
+			EndpointID: eid,
+			Interface:  &sdk.EndpointInterface{Address: "10.1.0.2/8"},
+		}); err != nil {
+			b.Fatal(err)
+		}
+		if pool != "0" {
+			waitPoolFull(b, d, nid)
+		}
+		b.StartTimer()
+		if _, err := d.Join(&sdk.JoinRequest{NetworkID: nid, EndpointID: eid, SandboxKey: "/nonexistent"}); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		if err := d.DeleteEndpoint(&sdk.DeleteEndpointRequest{NetworkID: nid, EndpointID: eid}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package macvlan
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	sdk "github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/types"
+)
+
+// parseStaticRoutes parses a comma separated list of routes for the
+// containers on a network. Each route is either '<cidr> via <ip>' routed
+// through a next hop on the network subnet or '<cidr> connected' for
+// destinations reachable directly on the macvlan segment. Example:
+// -o routes="10.0.0.0/8 via 192.168.1.254,172.16.0.0/12 connected"
+func parseStaticRoutes(opt string, subnet *net.IPNet) ([]*sdk.StaticRoute, error) {
+	var routes []*sdk.StaticRoute
+	for _, entry := range strings.Split(opt, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		_, dst, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid -o %s destination [ %s ]: %s", optRoutes, fields[0], err)
+		}
+		switch {
+		case len(fields) == 3 && fields[1] == "via":
+			nh := net.ParseIP(fields[2])
+			if nh == nil {
+				return nil, fmt.Errorf("invalid -o %s next hop [ %s ] for [ %s ]", optRoutes, fields[2], dst)
+			}
+			// the container can only resolve next hops on the macvlan segment
+			if subnet != nil && !subnet.Contains(nh) {
+				return nil, fmt.Errorf("-o %s next hop [ %s ] for [ %s ] is not on the network subnet [ %s ]", optRoutes, nh, dst, subnet)
+			}
+			routes = append(routes, &sdk.StaticRoute{
+				Destination: dst.String(),
+				RouteType:   types.NEXTHOP,
+				NextHop:     nh.String(),
+			})
+		case len(fields) == 2 && fields[1] == "connected":
+			routes = append(routes, &sdk.StaticRoute{
+				Destination: dst.String(),
+				RouteType:   types.CONNECTED,
+			})
+		default:
+			return nil, fmt.Errorf("invalid -o %s entry [ %s ], expected '<cidr> via <ip>' or '<cidr> connected'", optRoutes, strings.TrimSpace(entry))
+		}
+	}
+	return routes, nil
+}
@@ -0,0 +1,172 @@
+package macvlan
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	sandboxWaitTimeout  = 10 * time.Second
+	sandboxPollInterval = 10 * time.Millisecond
+)
+
+// sandboxHook configures an endpoint link once libnetwork has moved it into
+// the container netns. Link settings such as qdiscs don't survive a netns
+// move so they can only be applied from inside the sandbox.
+type sandboxHook func(l *callLog, link netlink.Link) error
+
+// sandboxHooks returns the hooks configuring the endpoint link in the sandbox
+func (ep *endpoint) sandboxHooks() []sandboxHook {
+	var hooks []sandboxHook
+	if ep.egress != nil {
+		hooks = append(hooks, ep.egress.hook())
+	}
+	if ep.antiSpoof && ep.mac != nil {
+		hooks = append(hooks, ep.antiSpoofHook())
+	}
+	if len(ep.sysctls) > 0 {
+		ep.savedSysctls = nil
+		hooks = append(hooks, sysctlHook(ep.sysctls, &ep.savedSysctls))
+	}
+	return hooks
+}
+
+// sandboxTeardown returns the hooks reversing sandboxHooks on Leave
+func (ep *endpoint) sandboxTeardown() []sandboxHook {
+	var hooks []sandboxHook
+	if len(ep.savedSysctls) > 0 {
+		hooks = append(hooks, restoreSysctlsHook(ep.savedSysctls))
+	}
+	if ep.antiSpoof && ep.mac != nil {
+		hooks = append(hooks, antiSpoofTeardown)
+	}
+	if ep.egress != nil {
+		hooks = append(hooks, ep.egress.teardown)
+	}
+	return hooks
+}
+
+// configureSandbox waits for libnetwork to rename the endpoint link from
+// srcName and bring it up in the sandbox netns, found by its mac address, and
+// runs the hooks against it. The link is set down when a hook fails so the
+// endpoint doesn't run without the settings it asked for.
+func configureSandbox(l *callLog, sandboxKey, srcName string, mac net.HardwareAddr, hooks []sandboxHook) error {
+	deadline := time.Now().Add(sandboxWaitTimeout)
+	for {
+		var link netlink.Link
+		err := inNetns(sandboxKey, func() error {
+			var err error
+			if link, err = linkByMac(mac); err != nil || link == nil {
+				return err
+			}
+			if link.Attrs().Name == srcName || link.Attrs().Flags&net.FlagUp == 0 {
+				link = nil
+				return nil
+			}
+			if err := runHooks(l, link, hooks); err != nil {
+				name := link.Attrs().Name
+				if downErr := l.audit(auditLinkDown, name, "sandbox configuration failed", linkOps.LinkSetDown(link)); downErr != nil {
+					l.Errorf("Unable to set link [ %s ] down after a failed sandbox configuration: %s", name, downErr)
+				}
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if link != nil {
+			log.Debugf("Configured link [ %s ] in sandbox [ %s ]", link.Attrs().Name, sandboxKey)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for the link with mac [ %s ] in sandbox [ %s ]", mac, sandboxKey)
+		}
+		time.Sleep(sandboxPollInterval)
+	}
+}
+
+// deconfigureSandbox runs the teardown hooks against the endpoint link still
+// in the sandbox. A sandbox or link already gone has nothing left to undo.
+func deconfigureSandbox(l *callLog, sandboxKey string, mac net.HardwareAddr, hooks []sandboxHook) error {
+	if _, err := os.Stat(sandboxKey); os.IsNotExist(err) {
+		return nil
+	}
+	return inNetns(sandboxKey, func() error {
+		link, err := linkByMac(mac)
+		if err != nil || link == nil {
+			return err
+		}
+		return runHooks(l, link, hooks)
+	})
+}
+
+func runHooks(l *callLog, link netlink.Link, hooks []sandboxHook) error {
+	for _, hook := range hooks {
+		if err := hook(l, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkByMac returns the link with the mac address in the current netns or nil
+func linkByMac(mac net.HardwareAddr) (netlink.Link, error) {
+	links, err := linkOps.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		if bytes.Equal(link.Attrs().HardwareAddr, mac) {
+			return link, nil
+		}
+	}
+	return nil, nil
+}
+
+// inNetns runs fn with the calling thread switched into the netns bind
+// mounted at path. netlink sockets opened by fn are created in that netns.
+func inNetns(path string, fn func() error) error {
+	runtime.LockOSThread()
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+	target, err := os.Open(path)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("unable to open the sandbox netns [ %s ]: %s", path, err)
+	}
+	defer target.Close()
+	if err := setns(target.Fd()); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("unable to enter the sandbox netns [ %s ]: %s", path, err)
+	}
+	fnErr := fn()
+	if err := setns(origin.Fd()); err != nil {
+		// leave the thread locked so it exits with the goroutine instead of
+		// being reused by the scheduler while still in the sandbox netns
+		log.Errorf("unable to restore the host netns after entering [ %s ]: %s", path, err)
+		return fnErr
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
+
+func setns(fd uintptr) error {
+	if _, _, errno := syscall.RawSyscall(unix.SYS_SETNS, fd, syscall.CLONE_NEWNET, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package macvlan
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var errShuttingDown = errors.New("the macvlan driver is shutting down")
+
+// startCall registers an in-flight driver call. It fails once Shutdown has
+// been called so no new host links are created while draining.
+func (d *Driver) startCall() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.stopping {
+		return errShuttingDown
+	}
+	d.calls.Add(1)
+	return nil
+}
+
+// Shutdown stops accepting driver calls and waits up to timeout for the
+// in-flight ones to finish so no half created macvlan links are left behind.
+func (d *Driver) Shutdown(timeout time.Duration) error {
+	d.Lock()
+	if d.stopping {
+		d.Unlock()
+		return nil
+	}
+	d.stopping = true
+	close(d.stop)
+	d.Unlock()
+	// pooled links are kept and adopted again on the next start
+	l := newCallLog("Shutdown", "", "", "")
+	for _, n := range d.getNetworks() {
+		n.stopPool(l, false)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		d.calls.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		log.Infof("All in-flight driver calls completed")
+		if d.store != nil {
+			return d.store.Close()
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %s waiting for in-flight driver calls to complete", timeout)
+	}
+}
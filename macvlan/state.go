@@ -5,8 +5,10 @@ import (
 	"sync"
 
 	"net"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	sdk "github.com/docker/go-plugins-helpers/network"
 	"github.com/docker/libnetwork/types"
 )
 
@@ -16,17 +18,62 @@ type network struct {
 	gateway   string
 	ifaceOpt  string
 	modeOpt   string
+	linkType  string
+	// bondSlaves are enslaved to the bond parent, created if it doesn't exist
+	bondSlaves []string
+	bondMode   string
+	// vxlan is a vxlan parent created by the driver
+	vxlan *vxlanParent
+	// ownsParent is set when the bond or vxlan parent was created by the
+	// driver, other parents are never deleted
+	ownsParent bool
+	// routeTable is the -o route_table policy routing table, 0 when unused
+	routeTable int
+	shimIface  string
+	// vrf is the -o vrf VRF the parent and shim are enslaved to. ownsVrf is
+	// set when the driver created it, vrfEnslaved are the links the driver
+	// enslaved to it.
+	vrf         string
+	ownsVrf     bool
+	vrfEnslaved []string
+	egress      *bandwidth
+	routes      []*sdk.StaticRoute
+	// noGateway leaves containers without a default route
+	noGateway bool
+	// keepDockerGateway leaves the default route to docker's gateway bridge
+	keepDockerGateway bool
+	// antiSpoof drops container frames with a foreign source mac or address
+	antiSpoof bool
+	// sysctls are applied to the container netns after Join
+	sysctls []sysctl
+	// pool keeps poolSize links ready for Join
+	poolSize int
+	pool     *linkPool
 	sync.Mutex
-	cidr *net.IPNet
+	cidr  *net.IPNet
+	cidr6 *net.IPNet
 }
 
 type networkTable map[string]*network
 
 type endpoint struct {
-	id      string
-	mac     net.HardwareAddr
-	addr    *net.IPNet
-	srcName string
+	id          string
+	mac         net.HardwareAddr
+	addr        *net.IPNet
+	addrv6      *net.IPNet
+	srcName     string
+	containerID string
+	created     time.Time
+	egress      *bandwidth
+	antiSpoof   bool
+	sysctls     []sysctl
+	sandboxKey  string
+	tap         *tapDevice
+	// configured is closed once the sandbox hooks of the last Join have run,
+	// savedSysctls holds the values they replaced. Leave waits on configured
+	// before reading savedSysctls.
+	configured   chan struct{}
+	savedSysctls []savedSysctl
 }
 
 type endpointTable map[string]*endpoint
@@ -73,11 +120,88 @@ func (n *network) getEndpoint(eid string) (*endpoint, error) {
 	return nil, nil
 }
 
+// Safely return a slice of the network endpoints
+func (n *network) getEndpoints() []*endpoint {
+	n.Lock()
+	defer n.Unlock()
+	ls := make([]*endpoint, 0, len(n.endpoints))
+	for _, ep := range n.endpoints {
+		ls = append(ls, ep)
+	}
+	return ls
+}
+
+// setContainer records the container an endpoint is attached to
+func (n *network) setContainer(eid, cid string) {
+	n.Lock()
+	if ep, ok := n.endpoints[eid]; ok {
+		ep.containerID = cid
+	}
+	n.Unlock()
+}
+
+// setSandbox records the netns an endpoint link is moved into
+func (n *network) setSandbox(eid, sandboxKey string) {
+	n.Lock()
+	if ep, ok := n.endpoints[eid]; ok {
+		ep.sandboxKey = sandboxKey
+	}
+	n.Unlock()
+}
+
+// setTap records the character device of a macvtap endpoint
+func (n *network) setTap(eid string, tap *tapDevice) {
+	n.Lock()
+	if ep, ok := n.endpoints[eid]; ok {
+		ep.tap = tap
+	}
+	n.Unlock()
+}
+
+// tapDevice returns the character device of a macvtap endpoint
+func (n *network) tapDevice(eid string) *tapDevice {
+	n.Lock()
+	defer n.Unlock()
+	if ep, ok := n.endpoints[eid]; ok {
+		return ep.tap
+	}
+	return nil
+}
+
+// linkPool returns the -o link_pool pool of the network or nil
+func (n *network) linkPool() *linkPool {
+	n.Lock()
+	defer n.Unlock()
+	return n.pool
+}
+
+// sandbox returns the netns an endpoint link was moved into
+func (n *network) sandbox(eid string) string {
+	n.Lock()
+	defer n.Unlock()
+	if ep, ok := n.endpoints[eid]; ok {
+		return ep.sandboxKey
+	}
+	return ""
+}
+
+// containerEndpoints returns the endpoints attached to a container
+func (n *network) containerEndpoints(cid string) []*endpoint {
+	n.Lock()
+	defer n.Unlock()
+	var ls []*endpoint
+	for _, ep := range n.endpoints {
+		if ep.containerID == cid {
+			ls = append(ls, ep)
+		}
+	}
+	return ls
+}
+
 func (d *Driver) network(nid string) *network {
 	d.Lock()
-	networks := d.networks
+	n, ok := d.networks[nid]
 	d.Unlock()
-	n, ok := networks[nid]
 	if !ok {
 		logrus.Errorf("network id %s not found", nid)
 	}
@@ -0,0 +1,65 @@
+package macvlan
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	scopeLocal  = "local"
+	scopeGlobal = "global"
+
+	// storePrefix namespaces the driver keys in a shared store
+	storePrefix = "macvlan/"
+)
+
+var (
+	// errKeyNotFound is returned by Get for missing keys
+	errKeyNotFound = errors.New("key not found")
+	// errKeyModified is returned by AtomicPut and AtomicDelete when the key
+	// was changed since the version passed in
+	errKeyModified = errors.New("key was modified concurrently")
+)
+
+// Store coordinates networks and allocations between the hosts of a global
+// scope deployment. Every write is a compare and swap against the version
+// returned by Get, version 0 meaning the key must not exist yet.
+type Store interface {
+	// Get returns the value and version of a key or errKeyNotFound
+	Get(key string) ([]byte, uint64, error)
+	// List returns the values of every key under a prefix
+	List(prefix string) (map[string][]byte, error)
+	// AtomicPut writes a key if its version is unchanged and returns the new version
+	AtomicPut(key string, value []byte, version uint64) (uint64, error)
+	// AtomicDelete deletes a key if its version is unchanged, a missing key
+	// is already deleted
+	AtomicDelete(key string, version uint64) error
+	Close() error
+}
+
+// newStore opens the store backend named by the --store url:
+// file:///var/lib/macvlan/store.json or etcd://10.0.0.1:2379,10.0.0.2:2379
+func newStore(uri string) (Store, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --store [ %s ]: %s", uri, err)
+	}
+	switch u.Scheme {
+	case "file":
+		return newFileStore(u.Path)
+	case "etcd", "etcds":
+		scheme := "http"
+		if u.Scheme == "etcds" {
+			scheme = "https"
+		}
+		var endpoints []string
+		for _, host := range strings.Split(u.Host, ",") {
+			endpoints = append(endpoints, scheme+"://"+host)
+		}
+		return newEtcdStore(endpoints)
+	default:
+		return nil, fmt.Errorf("invalid --store [ %s ], expected file:// or etcd://", uri)
+	}
+}
@@ -0,0 +1,193 @@
+package macvlan
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const etcdRequestTimeout = 5 * time.Second
+
+// etcdStore talks to the etcd v3 json gateway, /v3/kv/*, so no etcd client
+// library is needed. Key versions are the etcd mod revisions.
+type etcdStore struct {
+	endpoints []string
+	client    *http.Client
+}
+
+func newEtcdStore(endpoints []string) (*etcdStore, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no etcd endpoints")
+	}
+	return &etcdStore{
+		endpoints: endpoints,
+		client:    &http.Client{Timeout: etcdRequestTimeout},
+	}, nil
+}
+
+// etcdInt decodes the int64 fields the gateway encodes as json strings
+type etcdInt uint64
+
+func (i *etcdInt) UnmarshalJSON(b []byte) error {
+	n, err := strconv.ParseUint(string(bytes.Trim(b, `"`)), 10, 64)
+	*i = etcdInt(n)
+	return err
+}
+
+type etcdKeyValue struct {
+	Key         []byte  `json:"key"`
+	Value       []byte  `json:"value"`
+	ModRevision etcdInt `json:"mod_revision"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []etcdKeyValue `json:"kvs"`
+}
+
+type etcdCompare struct {
+	Key            []byte `json:"key"`
+	Target         string `json:"target"`
+	Result         string `json:"result"`
+	ModRevision    string `json:"mod_revision,omitempty"`
+	CreateRevision string `json:"create_revision,omitempty"`
+}
+
+type etcdPutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdOp struct {
+	RequestPut         *etcdPutRequest   `json:"request_put,omitempty"`
+	RequestDeleteRange *etcdRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+type etcdTxnRequest struct {
+	Compare []etcdCompare `json:"compare"`
+	Success []etcdOp      `json:"success"`
+}
+
+type etcdTxnResponse struct {
+	Header struct {
+		Revision etcdInt `json:"revision"`
+	} `json:"header"`
+	Succeeded bool `json:"succeeded"`
+}
+
+// post sends a request to the first endpoint that answers
+func (s *etcdStore) post(path string, req, res interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, ep := range s.endpoints {
+		resp, err := s.client.Post(ep+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("etcd %s returned [ %s ]: %s", path, resp.Status, bytes.TrimSpace(b))
+		}
+		return json.Unmarshal(b, res)
+	}
+	return fmt.Errorf("no etcd endpoint reachable: %s", lastErr)
+}
+
+func (s *etcdStore) Get(key string) ([]byte, uint64, error) {
+	res := &etcdRangeResponse{}
+	if err := s.post("/v3/kv/range", &etcdRangeRequest{Key: []byte(key)}, res); err != nil {
+		return nil, 0, err
+	}
+	if len(res.Kvs) == 0 {
+		return nil, 0, errKeyNotFound
+	}
+	return res.Kvs[0].Value, uint64(res.Kvs[0].ModRevision), nil
+}
+
+func (s *etcdStore) List(prefix string) (map[string][]byte, error) {
+	res := &etcdRangeResponse{}
+	if err := s.post("/v3/kv/range", &etcdRangeRequest{Key: []byte(prefix), RangeEnd: prefixEnd(prefix)}, res); err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(res.Kvs))
+	for _, kv := range res.Kvs {
+		values[string(kv.Key)] = kv.Value
+	}
+	return values, nil
+}
+
+func (s *etcdStore) AtomicPut(key string, value []byte, version uint64) (uint64, error) {
+	res := &etcdTxnResponse{}
+	req := &etcdTxnRequest{
+		Compare: []etcdCompare{versionCompare(key, version)},
+		Success: []etcdOp{{RequestPut: &etcdPutRequest{Key: []byte(key), Value: value}}},
+	}
+	if err := s.post("/v3/kv/txn", req, res); err != nil {
+		return 0, err
+	}
+	if !res.Succeeded {
+		return 0, errKeyModified
+	}
+	return uint64(res.Header.Revision), nil
+}
+
+func (s *etcdStore) AtomicDelete(key string, version uint64) error {
+	res := &etcdTxnResponse{}
+	req := &etcdTxnRequest{
+		Compare: []etcdCompare{versionCompare(key, version)},
+		Success: []etcdOp{{RequestDeleteRange: &etcdRangeRequest{Key: []byte(key)}}},
+	}
+	if err := s.post("/v3/kv/txn", req, res); err != nil {
+		return err
+	}
+	if !res.Succeeded {
+		// the compare also fails for a key that is already gone
+		if _, _, err := s.Get(key); err == errKeyNotFound {
+			return nil
+		}
+		return errKeyModified
+	}
+	return nil
+}
+
+func (s *etcdStore) Close() error {
+	return nil
+}
+
+// versionCompare checks the key doesn't exist for version 0, or is unchanged
+func versionCompare(key string, version uint64) etcdCompare {
+	if version == 0 {
+		return etcdCompare{Key: []byte(key), Target: "CREATE", Result: "EQUAL", CreateRevision: "0"}
+	}
+	return etcdCompare{Key: []byte(key), Target: "MOD", Result: "EQUAL", ModRevision: strconv.FormatUint(version, 10)}
+}
+
+// prefixEnd returns the range end matching every key with the prefix
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// every byte is 0xff, range to the end of the keyspace
+	return []byte{0}
+}
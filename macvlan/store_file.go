@@ -0,0 +1,141 @@
+package macvlan
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// fileStore keeps the keys in a json file guarded by an flock, for global
+// scope on a single host or hosts sharing a filesystem with working locks
+type fileStore struct {
+	path string
+	lock *os.File
+	// flock only excludes other processes, goroutines share the lock file description
+	sync.Mutex
+}
+
+type fileEntry struct {
+	Value   []byte `json:"value"`
+	Version uint64 `json:"version"`
+}
+
+type fileData struct {
+	// Revision is the last version handed out, versions are never reused
+	Revision uint64                `json:"revision"`
+	Keys     map[string]*fileEntry `json:"keys"`
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	if path == "" {
+		return nil, os.ErrInvalid
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	// the data file is replaced on every write so the lock is held on a separate file
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStore{path: path, lock: lock}, nil
+}
+
+// update runs fn with the file locked and writes the data back if fn changed it
+func (s *fileStore) update(fn func(data *fileData) (bool, error)) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := syscall.Flock(int(s.lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(s.lock.Fd()), syscall.LOCK_UN)
+	data := &fileData{Keys: make(map[string]*fileEntry)}
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, data); err != nil {
+			return err
+		}
+		if data.Keys == nil {
+			data.Keys = make(map[string]*fileEntry)
+		}
+	}
+	changed, err := fn(data)
+	if err != nil || !changed {
+		return err
+	}
+	if b, err = json.Marshal(data); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *fileStore) Get(key string) ([]byte, uint64, error) {
+	var entry *fileEntry
+	err := s.update(func(data *fileData) (bool, error) {
+		entry = data.Keys[key]
+		return false, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if entry == nil {
+		return nil, 0, errKeyNotFound
+	}
+	return entry.Value, entry.Version, nil
+}
+
+func (s *fileStore) List(prefix string) (map[string][]byte, error) {
+	values := make(map[string][]byte)
+	err := s.update(func(data *fileData) (bool, error) {
+		for k, e := range data.Keys {
+			if strings.HasPrefix(k, prefix) {
+				values[k] = e.Value
+			}
+		}
+		return false, nil
+	})
+	return values, err
+}
+
+func (s *fileStore) AtomicPut(key string, value []byte, version uint64) (uint64, error) {
+	var next uint64
+	err := s.update(func(data *fileData) (bool, error) {
+		if current := data.Keys[key]; (current == nil && version != 0) || (current != nil && current.Version != version) {
+			return false, errKeyModified
+		}
+		data.Revision++
+		next = data.Revision
+		data.Keys[key] = &fileEntry{Value: value, Version: next}
+		return true, nil
+	})
+	return next, err
+}
+
+func (s *fileStore) AtomicDelete(key string, version uint64) error {
+	return s.update(func(data *fileData) (bool, error) {
+		current := data.Keys[key]
+		if current == nil {
+			return false, nil
+		}
+		if current.Version != version {
+			return false, errKeyModified
+		}
+		delete(data.Keys, key)
+		return true, nil
+	})
+}
+
+func (s *fileStore) Close() error {
+	return s.lock.Close()
+}
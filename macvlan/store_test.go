@@ -0,0 +1,281 @@
+package macvlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStore checks the compare and swap semantics every Store backend implements
+func testStore(t *testing.T, s Store) {
+	if _, _, err := s.Get("macvlan/test/a"); err != errKeyNotFound {
+		t.Fatalf("Get of a missing key returned %v, want errKeyNotFound", err)
+	}
+	v1, err := s.AtomicPut("macvlan/test/a", []byte("1"), 0)
+	if err != nil {
+		t.Fatalf("AtomicPut of a new key: %v", err)
+	}
+	if _, err := s.AtomicPut("macvlan/test/a", []byte("2"), 0); err != errKeyModified {
+		t.Fatalf("AtomicPut of an existing key with version 0 returned %v, want errKeyModified", err)
+	}
+	b, version, err := s.Get("macvlan/test/a")
+	if err != nil || string(b) != "1" || version != v1 {
+		t.Fatalf("Get returned %q version %d, %v, want %q version %d", b, version, err, "1", v1)
+	}
+	v2, err := s.AtomicPut("macvlan/test/a", []byte("2"), v1)
+	if err != nil || v2 == v1 {
+		t.Fatalf("AtomicPut with the current version returned version %d, %v", v2, err)
+	}
+	if _, err := s.AtomicPut("macvlan/test/a", []byte("3"), v1); err != errKeyModified {
+		t.Fatalf("AtomicPut with a stale version returned %v, want errKeyModified", err)
+	}
+	if err := s.AtomicDelete("macvlan/test/a", v1); err != errKeyModified {
+		t.Fatalf("AtomicDelete with a stale version returned %v, want errKeyModified", err)
+	}
+	for _, key := range []string{"macvlan/test/b/1", "macvlan/test/b/2", "macvlan/test/bc", "macvlan/test/c"} {
+		if _, err := s.AtomicPut(key, []byte(key), 0); err != nil {
+			t.Fatalf("AtomicPut [ %s ]: %v", key, err)
+		}
+	}
+	values, err := s.List("macvlan/test/b/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var keys []string
+	for k, v := range values {
+		if k != string(v) {
+			t.Errorf("List returned [ %s ] with the value %q", k, v)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if fmt.Sprint(keys) != "[macvlan/test/b/1 macvlan/test/b/2]" {
+		t.Errorf("List of macvlan/test/b/ returned %v", keys)
+	}
+	if err := s.AtomicDelete("macvlan/test/a", v2); err != nil {
+		t.Fatalf("AtomicDelete with the current version: %v", err)
+	}
+	if _, _, err := s.Get("macvlan/test/a"); err != errKeyNotFound {
+		t.Fatalf("Get of a deleted key returned %v, want errKeyNotFound", err)
+	}
+	if err := s.AtomicDelete("macvlan/test/a", v2); err != nil {
+		t.Fatalf("AtomicDelete of a missing key: %v", err)
+	}
+	// a deleted key can be created again
+	if _, err := s.AtomicPut("macvlan/test/a", []byte("4"), 0); err != nil {
+		t.Fatalf("AtomicPut of a deleted key: %v", err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macvlan-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newStore("file://" + filepath.Join(dir, "store.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testStore(t, s)
+}
+
+// TestEtcdStore runs the store tests against fakeEtcd, an in-memory fake of
+// the etcd v3 json gateway, and against a real etcd when the etcd binary is
+// in the PATH
+func TestEtcdStore(t *testing.T) {
+	srv := httptest.NewServer(newFakeEtcd())
+	defer srv.Close()
+	s, err := newStore("etcd://" + srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+
+	endpoint, stop := startEtcd(t)
+	if endpoint == "" {
+		return
+	}
+	defer stop()
+	if s, err = newStore("etcd://" + endpoint); err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
+
+// startEtcd runs the etcd binary on a temporary data dir, the test is
+// skipped when it isn't installed
+func startEtcd(t *testing.T) (string, func()) {
+	bin, err := exec.LookPath("etcd")
+	if err != nil {
+		t.Log("etcd isn't installed, only the embedded gateway was tested")
+		return "", nil
+	}
+	dir, err := ioutil.TempDir("", "macvlan-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, peer := freePort(t), freePort(t)
+	cmd := exec.Command(bin, "--data-dir", dir,
+		"--listen-client-urls", "http://"+client, "--advertise-client-urls", "http://"+client,
+		"--listen-peer-urls", "http://"+peer, "--initial-advertise-peer-urls", "http://"+peer,
+		"--initial-cluster", "default=http://"+peer)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if resp, err := http.Get("http://" + client + "/health"); err == nil {
+			resp.Body.Close()
+			return client, stop
+		}
+	}
+	stop()
+	t.Fatal("etcd didn't start")
+	return "", nil
+}
+
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// fakeEtcd implements the range and txn calls of the etcd v3 json gateway
+// used by etcdStore, with the etcd revision semantics
+type fakeEtcd struct {
+	sync.Mutex
+	revision int64
+	kvs      map[string]*fakeKeyValue
+}
+
+type fakeKeyValue struct {
+	value          []byte
+	createRevision int64
+	modRevision    int64
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{kvs: make(map[string]*fakeKeyValue)}
+}
+
+func (e *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.Lock()
+	defer e.Unlock()
+	var res interface{}
+	var err error
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		req := &etcdRangeRequest{}
+		if err = json.NewDecoder(r.Body).Decode(req); err == nil {
+			res = e.rangeKeys(req)
+		}
+	case "/v3/kv/txn":
+		req := &etcdTxnRequest{}
+		if err = json.NewDecoder(r.Body).Decode(req); err == nil {
+			res = e.txn(req)
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func (e *fakeEtcd) inRange(key string, req *etcdRangeRequest) bool {
+	switch {
+	case len(req.RangeEnd) == 0:
+		return key == string(req.Key)
+	case string(req.RangeEnd) == "\x00":
+		return key >= string(req.Key)
+	}
+	return key >= string(req.Key) && key < string(req.RangeEnd)
+}
+
+func (e *fakeEtcd) rangeKeys(req *etcdRangeRequest) map[string]interface{} {
+	var kvs []map[string]interface{}
+	for k, kv := range e.kvs {
+		if e.inRange(k, req) {
+			kvs = append(kvs, map[string]interface{}{
+				"key":             []byte(k),
+				"value":           kv.value,
+				"create_revision": strconv.FormatInt(kv.createRevision, 10),
+				"mod_revision":    strconv.FormatInt(kv.modRevision, 10),
+			})
+		}
+	}
+	return map[string]interface{}{"header": e.header(), "kvs": kvs}
+}
+
+func (e *fakeEtcd) txn(req *etcdTxnRequest) map[string]interface{} {
+	succeeded := true
+	for _, c := range req.Compare {
+		var current int64
+		want := c.ModRevision
+		kv := e.kvs[string(c.Key)]
+		switch c.Target {
+		case "MOD":
+			if kv != nil {
+				current = kv.modRevision
+			}
+		case "CREATE":
+			if kv != nil {
+				current = kv.createRevision
+			}
+			want = c.CreateRevision
+		}
+		if want == "" {
+			want = "0"
+		}
+		succeeded = succeeded && c.Result == "EQUAL" && strconv.FormatInt(current, 10) == want
+	}
+	if succeeded {
+		for _, op := range req.Success {
+			switch {
+			case op.RequestPut != nil:
+				e.revision++
+				key := string(op.RequestPut.Key)
+				kv := &fakeKeyValue{value: op.RequestPut.Value, createRevision: e.revision, modRevision: e.revision}
+				if prev := e.kvs[key]; prev != nil {
+					kv.createRevision = prev.createRevision
+				}
+				e.kvs[key] = kv
+			case op.RequestDeleteRange != nil:
+				for k := range e.kvs {
+					if e.inRange(k, op.RequestDeleteRange) {
+						e.revision++
+						delete(e.kvs, k)
+					}
+				}
+			}
+		}
+	}
+	return map[string]interface{}{"header": e.header(), "succeeded": succeeded}
+}
+
+func (e *fakeEtcd) header() map[string]string {
+	return map[string]string{"revision": strconv.FormatInt(e.revision, 10)}
+}
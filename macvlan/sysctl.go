@@ -0,0 +1,157 @@
+package macvlan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// optSysctlPrefix prefixes sysctls applied in the sandbox, -o sysctl.arp_ignore=1
+	optSysctlPrefix = "sysctl."
+	optIPv6Autoconf = "ipv6_autoconf"
+
+	procSys = "/proc/sys"
+)
+
+// sysctlKey only allows dotted sysctl names, nothing that could escape /proc/sys
+var sysctlKey = regexp.MustCompile(`^[a-z0-9_]+(\.[a-z0-9_]+)*$`)
+
+// sysctl is a setting applied inside the container netns. Short keys such
+// as arp_ignore are per interface settings of the container link, looked up
+// under net.ipv4.conf then net.ipv6.conf. Full names must be under net.,
+// the only sysctls scoped to the netns.
+type sysctl struct {
+	key   string
+	value string
+}
+
+// parseSysctls reads the sysctl.* and ipv6_autoconf options. Endpoint
+// settings override the inherited network ones with the same key.
+func parseSysctls(opts map[string]string, inherited []sysctl) ([]sysctl, error) {
+	settings := make(map[string]string, len(inherited))
+	for _, s := range inherited {
+		settings[s.key] = s.value
+	}
+	for k, v := range opts {
+		if !strings.HasPrefix(k, optSysctlPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(k, optSysctlPrefix)
+		if !sysctlKey.MatchString(key) || (strings.Contains(key, ".") && !strings.HasPrefix(key, "net.")) {
+			return nil, fmt.Errorf("invalid -o %s, expected an interface setting or a net.* sysctl", k)
+		}
+		if v == "" || strings.ContainsAny(v, "\n\x00") {
+			return nil, fmt.Errorf("invalid -o %s=%q", k, v)
+		}
+		settings[key] = v
+	}
+	if v, ok := opts[optIPv6Autoconf]; ok {
+		autoconf, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -o %s=%s, expected true or false", optIPv6Autoconf, v)
+		}
+		// only net.ipv6.conf has an autoconf setting
+		settings["autoconf"] = "0"
+		if autoconf {
+			settings["autoconf"] = "1"
+		}
+	}
+	var sysctls []sysctl
+	for k, v := range settings {
+		sysctls = append(sysctls, sysctl{key: k, value: v})
+	}
+	sort.Sort(sysctlsByKey(sysctls))
+	return sysctls, nil
+}
+
+// savedSysctl is the value a sandbox setting had before Join changed it
+type savedSysctl struct {
+	sysctl
+	value string
+}
+
+type sysctlsByKey []sysctl
+
+func (s sysctlsByKey) Len() int           { return len(s) }
+func (s sysctlsByKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sysctlsByKey) Less(i, j int) bool { return s[i].key < s[j].key }
+
+// path returns the /proc/sys file of the setting for the container link
+func (s sysctl) path(link string) (string, error) {
+	if strings.Contains(s.key, ".") {
+		return filepath.Join(append([]string{procSys}, strings.Split(s.key, ".")...)...), nil
+	}
+	for _, family := range []string{"ipv4", "ipv6"} {
+		p := filepath.Join(procSys, "net", family, "conf", link, s.key)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown interface setting [ %s ]", s.key)
+}
+
+// sysctlHook writes the settings from inside the sandbox, /proc/sys/net
+// files opened there belong to the container netns. The values replaced are
+// saved for Leave to restore.
+func sysctlHook(sysctls []sysctl, saved *[]savedSysctl) sandboxHook {
+	return func(l *callLog, link netlink.Link) error {
+		for _, s := range sysctls {
+			p, err := s.linkPath(link)
+			if err != nil {
+				return err
+			}
+			if b, err := ioutil.ReadFile(p); err == nil {
+				*saved = append(*saved, savedSysctl{sysctl: s, value: strings.TrimSpace(string(b))})
+			}
+			if err := l.audit(auditSysctl, p, s.value, ioutil.WriteFile(p, []byte(s.value), 0644)); err != nil {
+				return fmt.Errorf("unable to set [ %s ] to [ %s ]: %s", s.key, s.value, err)
+			}
+		}
+		return nil
+	}
+}
+
+// restoreSysctlsHook writes back the values saved by sysctlHook, last change first
+func restoreSysctlsHook(saved []savedSysctl) sandboxHook {
+	return func(l *callLog, link netlink.Link) error {
+		for i := len(saved) - 1; i >= 0; i-- {
+			s := saved[i]
+			p, err := s.linkPath(link)
+			if err != nil {
+				return err
+			}
+			if err := l.audit(auditSysctl, p, s.value, ioutil.WriteFile(p, []byte(s.value), 0644)); err != nil {
+				return fmt.Errorf("unable to restore [ %s ] to [ %s ]: %s", p, s.value, err)
+			}
+		}
+		return nil
+	}
+}
+
+// linkPath returns the /proc/sys file of the setting for the link as it is
+// named when the file is written, looked up by its index since the name
+// changes when libnetwork moves the link into the sandbox
+func (s sysctl) linkPath(link netlink.Link) (string, error) {
+	current, err := linkOps.LinkByIndex(link.Attrs().Index)
+	if err != nil {
+		return "", fmt.Errorf("unable to find the link [ %s ]: %s", link.Attrs().Name, err)
+	}
+	return s.path(current.Attrs().Name)
+}
+
+// sysctlInfo reports the sandbox settings of an endpoint
+func sysctlInfo(sysctls []sysctl) map[string]string {
+	info := make(map[string]string, len(sysctls))
+	for _, s := range sysctls {
+		info[optSysctlPrefix+s.key] = s.value
+	}
+	return info
+}
@@ -8,6 +8,44 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
+// driverLinkAlias marks the host links created by the driver. The mark lives
+// on the link so a restarted plugin still tells them apart from links the
+// operator created, which are never deleted.
+const driverLinkAlias = "created by macvlan-docker-plugin"
+
+// markDriverLink sets the alias of a link created by the driver
+func markDriverLink(l *callLog, link netlink.Link) error {
+	return setLinkAlias(l, link, driverLinkAlias)
+}
+
+// endpointLinkAlias marks the endpoint and pool links created for a network,
+// only links of a network the driver knows are deleted as orphans
+func endpointLinkAlias(nid string) string {
+	return driverLinkAlias + " for network " + nid
+}
+
+func setLinkAlias(l *callLog, link netlink.Link, alias string) error {
+	name := link.Attrs().Name
+	if err := l.audit(auditLinkAlias, name, alias, linkOps.LinkSetAlias(link, alias)); err != nil {
+		return fmt.Errorf("unable to set the alias of [ %s ]: %s", name, err)
+	}
+	return nil
+}
+
+// isDriverLink reports whether a link was created by the driver
+func isDriverLink(link netlink.Link) bool {
+	return link.Attrs().Alias == driverLinkAlias
+}
+
+// linkMTU is the MTU of the links created on a parent, a macvlan can't have
+// a larger MTU than its parent such as a vxlan interface
+func linkMTU(parent netlink.Link) int {
+	if mtu := parent.Attrs().MTU; mtu > 0 && mtu < defaultMTU {
+		return mtu
+	}
+	return defaultMTU
+}
+
 // Generate a mac addr
 func makeMac(ip net.IP) string {
 	hw := make(net.HardwareAddr, 6)
@@ -19,7 +57,7 @@ func makeMac(ip net.IP) string {
 
 // Return the IPv4 address of a network interface
 func getIfaceAddr(name string) (*net.IPNet, error) {
-	iface, err := netlink.LinkByName(name)
+	iface, err := linkOps.LinkByName(name)
 	if err != nil {
 		return nil, err
 	}
@@ -69,7 +107,7 @@ func ipIncrement(networkAddr net.IP) net.IP {
 
 // Check if a netlink interface exists in the default namespace
 func validateHostIface(ifaceStr string) bool {
-	_, err := net.InterfaceByName(ifaceStr)
+	_, err := linkOps.LinkByName(ifaceStr)
 	if err != nil {
 		log.Debugf("The requested interface to delete [ %s ] was not found on the host: %s", ifaceStr, err)
 		return false
@@ -77,6 +115,28 @@ func validateHostIface(ifaceStr string) bool {
 	return true
 }
 
+// hostLinkName returns the unique name of an endpoint link while it is still in the host netns
+func hostLinkName(eid string) string {
+	return eid[:5]
+}
+
+// deleteHostLink deletes a link from the host netns, returning true if it existed
+func deleteHostLink(l *callLog, name string) bool {
+	if ok := validateHostIface(name); !ok {
+		return false
+	}
+	link, err := linkOps.LinkByName(name)
+	if err != nil {
+		log.Errorf("Error looking up link [ %s ]: %s", name, err)
+		return false
+	}
+	if err := l.audit(auditLinkDel, name, link.Type(), linkOps.LinkDel(link)); err != nil {
+		log.Errorf("unable to delete the macvlan link [ %s ]: %s", name, err)
+		return false
+	}
+	return true
+}
+
 // parseIPNet returns a net.IP from a network cidr in string representation
 func parseIPNet(s string) (*net.IPNet, error) {
 	ip, ipNet, err := net.ParseCIDR(s)
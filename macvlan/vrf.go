@@ -0,0 +1,253 @@
+package macvlan
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	optVrf = "vrf"
+
+	// IFLA_VRF_TABLE from linux/if_link.h, the vendored netlink has no vrf links
+	iflaVrfTable = 1
+	// vrfTableBase is the first table handed to a VRF created without -o route_table
+	vrfTableBase = 1000
+)
+
+// vrfTables returns the routing table of every VRF on the host by name
+func vrfTables() (map[string]int, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, syscall.NLM_F_DUMP)
+	req.AddData(nl.NewIfInfomsg(syscall.AF_UNSPEC))
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK)
+	if err != nil {
+		return nil, err
+	}
+	tables := make(map[string]int)
+	for _, m := range msgs {
+		if len(m) < syscall.SizeofIfInfomsg {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[syscall.SizeofIfInfomsg:])
+		if err != nil {
+			continue
+		}
+		kind := nestedAttrs(attrs, syscall.IFLA_LINKINFO, nl.IFLA_INFO_KIND)
+		if len(kind) == 0 || strings.TrimRight(string(kind[0].Value), "\x00") != "vrf" {
+			continue
+		}
+		name := nestedAttrs(attrs, syscall.IFLA_IFNAME)
+		table := nestedAttrs(attrs, syscall.IFLA_LINKINFO, nl.IFLA_INFO_DATA, iflaVrfTable)
+		if len(name) == 0 || len(table) == 0 || len(table[0].Value) < 4 {
+			continue
+		}
+		tables[strings.TrimRight(string(name[0].Value), "\x00")] = int(nl.NativeEndian().Uint32(table[0].Value))
+	}
+	return tables, nil
+}
+
+// addVrf creates a VRF bound to a routing table, ip link add X type vrf table N
+func addVrf(name string, table int) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(syscall.AF_UNSPEC))
+	req.AddData(nl.NewRtAttr(syscall.IFLA_IFNAME, nl.ZeroTerminated(name)))
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated("vrf"))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	nl.NewRtAttrChild(data, iflaVrfTable, nl.Uint32Attr(uint32(table)))
+	req.AddData(linkInfo)
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// freeVrfTable returns the first table from vrfTableBase without a VRF or routes
+func freeVrfTable(tables map[string]int) int {
+	used := make(map[int]bool, len(tables))
+	for _, t := range tables {
+		used[t] = true
+	}
+	for table := vrfTableBase; ; table++ {
+		if used[table] {
+			continue
+		}
+		empty := true
+		for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+			routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+			if err != nil || len(routes) > 0 {
+				empty = false
+			}
+		}
+		if empty {
+			return table
+		}
+	}
+}
+
+// setupVrf creates the -o vrf VRF if needed and enslaves the parent and host
+// shim to it. The network table becomes the VRF table. undo reverts what the
+// call changed, the VRF it created or the links it enslaved.
+func (n *network) setupVrf(l *callLog) (undo func(), err error) {
+	if n.vrf == "" {
+		return nil, nil
+	}
+	tables, err := vrfTables()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the VRFs: %s", err)
+	}
+	var created bool
+	var enslaved []string
+	undo = func() {
+		if created {
+			n.deleteVrf(l)
+			return
+		}
+		n.releaseVrf(l, enslaved)
+	}
+	table, ok := tables[n.vrf]
+	switch {
+	case ok && n.routeTable != 0 && n.routeTable != table:
+		return nil, fmt.Errorf("VRF [ %s ] uses table [ %d ], not -o %s=%d", n.vrf, table, optRouteTable, n.routeTable)
+	case !ok:
+		if _, err := linkOps.LinkByName(n.vrf); err == nil {
+			return nil, fmt.Errorf("-o %s=%s is an existing link that isn't a VRF", optVrf, n.vrf)
+		}
+		table = n.routeTable
+		if table == 0 {
+			table = freeVrfTable(tables)
+		}
+		if err := l.audit(auditLinkAdd, n.vrf, fmt.Sprintf("vrf table %d", table), addVrf(n.vrf, table)); err != nil {
+			return nil, fmt.Errorf("unable to create VRF [ %s ] with table [ %d ]: %s", n.vrf, table, err)
+		}
+		vrf, err := linkOps.LinkByName(n.vrf)
+		if err == nil {
+			if err = markDriverLink(l, vrf); err != nil {
+				l.audit(auditLinkDel, n.vrf, "vrf", linkOps.LinkDel(vrf))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		created = true
+		log.Infof("Created VRF [ %s ] with table [ %d ]", n.vrf, table)
+	}
+	n.routeTable = table
+	vrf, err := linkOps.LinkByName(n.vrf)
+	if err != nil {
+		return undo, err
+	}
+	n.ownsVrf = isDriverLink(vrf)
+	if err := l.audit(auditLinkUp, n.vrf, "", linkOps.LinkSetUp(vrf)); err != nil {
+		return undo, fmt.Errorf("unable to bring up VRF [ %s ]: %s", n.vrf, err)
+	}
+	for _, name := range []string{n.ifaceOpt, n.shimIface} {
+		if name == "" {
+			continue
+		}
+		link, err := linkOps.LinkByName(name)
+		if err != nil {
+			return undo, fmt.Errorf("unable to find [ %s ] to enslave to VRF [ %s ]: %s", name, n.vrf, err)
+		}
+		if link.Attrs().MasterIndex == vrf.Attrs().Index {
+			continue
+		}
+		if err := l.audit(auditLinkMaster, name, n.vrf, linkOps.LinkSetMasterByIndex(link, vrf.Attrs().Index)); err != nil {
+			return undo, fmt.Errorf("unable to enslave [ %s ] to VRF [ %s ]: %s", name, n.vrf, err)
+		}
+		enslaved = append(enslaved, name)
+		log.Infof("Enslaved [ %s ] to VRF [ %s ]", name, n.vrf)
+	}
+	n.Lock()
+	n.vrfEnslaved = append(n.vrfEnslaved, enslaved...)
+	n.Unlock()
+	return undo, nil
+}
+
+// checkVrfGateway verifies the gateway is reachable inside the VRF,
+// ip route get <gateway> vrf X
+func (n *network) checkVrfGateway() error {
+	gw := net.ParseIP(n.gateway)
+	if n.vrf == "" || gw == nil || n.noGateway {
+		return nil
+	}
+	vrf, err := linkOps.LinkByName(n.vrf)
+	if err != nil {
+		return err
+	}
+	req := nl.NewNetlinkRequest(syscall.RTM_GETROUTE, 0)
+	msg := nl.NewRtMsg()
+	dst := gw.To4()
+	msg.Family = syscall.AF_INET
+	if dst == nil {
+		dst = gw.To16()
+		msg.Family = syscall.AF_INET6
+	}
+	msg.Dst_len = uint8(len(dst) * 8)
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(syscall.RTA_DST, dst))
+	req.AddData(nl.NewRtAttr(syscall.RTA_OIF, nl.Uint32Attr(uint32(vrf.Attrs().Index))))
+	if _, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWROUTE); err != nil {
+		return fmt.Errorf("gateway [ %s ] is not reachable in VRF [ %s ]: %s", n.gateway, n.vrf, err)
+	}
+	return nil
+}
+
+// deleteVrf releases the parent and host shim and deletes a VRF created by
+// the driver. From a VRF the operator created only the links the driver
+// enslaved are released.
+func (n *network) deleteVrf(l *callLog) {
+	if !n.ownsVrf {
+		n.Lock()
+		enslaved := n.vrfEnslaved
+		n.Unlock()
+		n.releaseVrf(l, enslaved)
+		return
+	}
+	vrf, err := linkOps.LinkByName(n.vrf)
+	if err != nil || !isDriverLink(vrf) {
+		return
+	}
+	n.releaseVrf(l, []string{n.ifaceOpt, n.shimIface})
+	if err := l.audit(auditLinkDel, n.vrf, "vrf", linkOps.LinkDel(vrf)); err != nil {
+		log.Warnf("Unable to delete VRF [ %s ]: %s", n.vrf, err)
+		return
+	}
+	log.Infof("Deleted VRF [ %s ]", n.vrf)
+}
+
+// releaseVrf removes links from the network VRF
+func (n *network) releaseVrf(l *callLog, names []string) {
+	vrf, err := linkOps.LinkByName(n.vrf)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		link, err := linkOps.LinkByName(name)
+		if err != nil || link.Attrs().MasterIndex != vrf.Attrs().Index {
+			continue
+		}
+		if err := l.audit(auditLinkNoMaster, name, n.vrf, linkOps.LinkSetNoMaster(link)); err != nil {
+			log.Warnf("Unable to release [ %s ] from VRF [ %s ]: %s", name, n.vrf, err)
+		}
+	}
+}
+
+// vrfNetworks returns the IDs of the networks in a VRF
+func (d *Driver) vrfNetworks(name string) []string {
+	var ids []string
+	for _, n := range d.getNetworks() {
+		if n.vrf == name {
+			ids = append(ids, n.id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,187 @@
+package macvlan
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	optVxlanID      = "vxlan_id"
+	optVxlanRemotes = "vxlan_remotes"
+	optVxlanDev     = "vxlan_dev"
+
+	// IANA assigned vxlan port, the kernel default is the legacy 8472
+	vxlanPort  = 4789
+	maxVxlanID = 1<<24 - 1
+)
+
+// vxlanParent is a vxlan interface created by the driver as the parent of a
+// network. Broadcast and unknown unicast frames are replicated to every
+// remote VTEP through static all-zero FDB entries, and the VTEP of a remote
+// mac is learned from the frames it sends so known unicast goes to one VTEP.
+type vxlanParent struct {
+	id      int
+	remotes []net.IP
+	dev     string
+}
+
+// parseVxlan reads the -o vxlan_id, -o vxlan_remotes and -o vxlan_dev options
+func parseVxlan(opts map[string]string) (*vxlanParent, error) {
+	v, ok := opts[optVxlanID]
+	if !ok {
+		for _, opt := range []string{optVxlanRemotes, optVxlanDev} {
+			if _, ok := opts[opt]; ok {
+				return nil, fmt.Errorf("-o %s requires -o %s to be set", opt, optVxlanID)
+			}
+		}
+		return nil, nil
+	}
+	id, err := strconv.Atoi(v)
+	if err != nil || id < 1 || id > maxVxlanID {
+		return nil, fmt.Errorf("invalid -o %s=%s, expected a VNI between 1 and %d", optVxlanID, v, maxVxlanID)
+	}
+	vx := &vxlanParent{id: id, dev: opts[optVxlanDev]}
+	for _, r := range strings.Split(opts[optVxlanRemotes], ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		ip := net.ParseIP(r)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid -o %s address [ %s ]", optVxlanRemotes, r)
+		}
+		vx.remotes = append(vx.remotes, ip)
+	}
+	if len(vx.remotes) == 0 {
+		return nil, fmt.Errorf("-o %s requires at least one address in -o %s", optVxlanID, optVxlanRemotes)
+	}
+	return vx, nil
+}
+
+// defaultName is the parent name used when the network has no -o host_iface
+func (vx *vxlanParent) defaultName() string {
+	return fmt.Sprintf("vxlan%d", vx.id)
+}
+
+// setup creates the vxlan interface if it doesn't exist and adds an FDB
+// entry for every remote. An existing interface with the same VNI is reused,
+// owned reports whether the interface was created by the driver.
+func (vx *vxlanParent) setup(l *callLog, name string) (owned bool, err error) {
+	link, err := linkOps.LinkByName(name)
+	if err == nil {
+		existing, ok := link.(*netlink.Vxlan)
+		if !ok || existing.VxlanId != vx.id {
+			return false, fmt.Errorf("-o %s=%s exists and is not a vxlan interface with VNI %d", optHostIface, name, vx.id)
+		}
+		owned = isDriverLink(link)
+	} else {
+		vxlan := &netlink.Vxlan{
+			LinkAttrs: netlink.LinkAttrs{Name: name, TxQLen: -1},
+			VxlanId:   vx.id,
+			Learning:  true,
+			// the vendored netlink sends the port in host byte order
+			Port: int(nl.Swap16(vxlanPort)),
+		}
+		if vx.dev != "" {
+			dev, err := linkOps.LinkByName(vx.dev)
+			if err != nil {
+				return false, fmt.Errorf("unable to find the -o %s=%s interface: %s", optVxlanDev, vx.dev, err)
+			}
+			vxlan.VtepDevIndex = dev.Attrs().Index
+		}
+		if err := l.audit(auditLinkAdd, name, fmt.Sprintf("vxlan id %d", vx.id), linkOps.LinkAdd(vxlan)); err != nil {
+			return false, fmt.Errorf("unable to create the vxlan interface [ %s ]: %s", name, err)
+		}
+		if err := markDriverLink(l, vxlan); err != nil {
+			l.audit(auditLinkDel, name, "vxlan", linkOps.LinkDel(vxlan))
+			return false, err
+		}
+		link, owned = vxlan, true
+		log.Infof("Created the vxlan interface [ %s ] with VNI [ %d ]", name, vx.id)
+	}
+	for _, remote := range vx.remotes {
+		if err := l.audit(auditFdbAdd, name, remote.String(), netlink.NeighAppend(remoteFdb(link, remote))); err != nil && err != syscall.EEXIST {
+			return owned, fmt.Errorf("unable to add the remote [ %s ] to the vxlan interface [ %s ]: %s", remote, name, err)
+		}
+	}
+	if err := l.audit(auditLinkUp, name, "", linkOps.LinkSetUp(link)); err != nil {
+		return owned, fmt.Errorf("unable to bring up the vxlan interface [ %s ]: %s", name, err)
+	}
+	return owned, nil
+}
+
+// deleteRemotes deletes the FDB entries of the remotes from a vxlan interface
+// that outlives the network, except the remotes of the networks still using it
+func (vx *vxlanParent) deleteRemotes(l *callLog, name string, keep []net.IP) {
+	link, err := linkOps.LinkByName(name)
+	if err != nil {
+		return
+	}
+	if _, ok := link.(*netlink.Vxlan); !ok {
+		return
+	}
+	for _, remote := range vx.remotes {
+		if ipIn(remote, keep) {
+			continue
+		}
+		if err := l.audit(auditFdbDel, name, remote.String(), netlink.NeighDel(remoteFdb(link, remote))); err != nil && err != syscall.ENOENT {
+			log.Warnf("Unable to delete the remote [ %s ] from the vxlan interface [ %s ]: %s", remote, name, err)
+		}
+	}
+}
+
+// remoteFdb is the all-zero FDB entry replicating broadcast and unknown
+// unicast frames to a remote
+func remoteFdb(link netlink.Link, remote net.IP) *netlink.Neigh {
+	return &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       syscall.AF_BRIDGE,
+		State:        netlink.NUD_PERMANENT | netlink.NUD_NOARP,
+		Flags:        netlink.NTF_SELF,
+		IP:           remote,
+		HardwareAddr: make(net.HardwareAddr, 6),
+	}
+}
+
+func ipIn(ip net.IP, ips []net.IP) bool {
+	for _, other := range ips {
+		if other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// vxlanRemotes returns the remotes of the vxlan networks on a parent
+func (d *Driver) vxlanRemotes(parent string) []net.IP {
+	var remotes []net.IP
+	for _, n := range d.getNetworks() {
+		if n.ifaceOpt == parent && n.vxlan != nil {
+			remotes = append(remotes, n.vxlan.remotes...)
+		}
+	}
+	return remotes
+}
+
+// deleteVxlan deletes a vxlan interface created by the driver. Interfaces
+// the operator created are left alone.
+func deleteVxlan(l *callLog, name string) {
+	link, err := linkOps.LinkByName(name)
+	if err != nil {
+		return
+	}
+	if _, ok := link.(*netlink.Vxlan); !ok || !isDriverLink(link) {
+		return
+	}
+	if err := l.audit(auditLinkDel, name, "vxlan", linkOps.LinkDel(link)); err != nil {
+		log.Errorf("Unable to delete the vxlan interface [ %s ]: %s", name, err)
+		return
+	}
+	log.Infof("Deleted the vxlan interface [ %s ]", name)
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
@@ -13,18 +16,146 @@ const (
 	version = "0.4.0"
 )
 
-func main() {
-
-	var flagDebug = cli.BoolFlag{
-		Name:  "debug, d",
-		Usage: "enable debugging",
+// Flags are bound to MACVLAN_* env vars so they can be set with
+// 'docker plugin set' when running as a managed plugin
+var (
+	flagDebug = cli.BoolFlag{
+		Name:   "debug, d",
+		Usage:  "enable debugging",
+		EnvVar: "MACVLAN_DEBUG",
+	}
+	flagLogFormat = cli.StringFlag{
+		Name:   "log-format",
+		Value:  "text",
+		Usage:  "log format [text|json], json logs carry the call, correlation_id, network_id, endpoint_id and sandbox as fields",
+		EnvVar: "MACVLAN_LOG_FORMAT",
+	}
+	flagLogFile = cli.StringFlag{
+		Name:   "log-file",
+		Usage:  "log to a file rotated by size instead of stderr",
+		EnvVar: "MACVLAN_LOG_FILE",
+	}
+	flagLogMaxSize = cli.IntFlag{
+		Name:   "log-max-size",
+		Value:  100,
+		Usage:  "size in MB the --log-file is rotated at",
+		EnvVar: "MACVLAN_LOG_MAX_SIZE",
+	}
+	flagLogMaxFiles = cli.IntFlag{
+		Name:   "log-max-files",
+		Value:  5,
+		Usage:  "number of rotated --log-file files kept",
+		EnvVar: "MACVLAN_LOG_MAX_FILES",
+	}
+	flagAuditLog = cli.StringFlag{
+		Name:   "audit-log",
+		Usage:  "append a JSON line per host network change to this file, read it with 'macvlan audit'",
+		EnvVar: "MACVLAN_AUDIT_LOG",
+	}
+	flagListen = cli.StringFlag{
+		Name:   "listen",
+		Value:  defaultListen,
+		Usage:  "address the plugin API is served on [unix:///path/to.sock|tcp://addr:port]",
+		EnvVar: "MACVLAN_LISTEN",
+	}
+	flagAdminSocket = cli.StringFlag{
+		Name:   "admin-socket",
+		Value:  defaultAdminSocket,
+		Usage:  "unix socket /healthz is served on for 'macvlan health', empty to disable",
+		EnvVar: "MACVLAN_ADMIN_SOCKET",
+	}
+	flagDockerHost = cli.StringFlag{
+		Name:   "docker-host",
+		Value:  macvlan.DefaultDockerHost,
+		Usage:  "docker API endpoint used to look up existing networks",
+		EnvVar: "DOCKER_HOST",
+	}
+	flagShutdownTimeout = cli.DurationFlag{
+		Name:   "shutdown-timeout",
+		Value:  30 * time.Second,
+		Usage:  "how long to wait for in-flight driver calls to complete on SIGTERM/SIGINT",
+		EnvVar: "MACVLAN_SHUTDOWN_TIMEOUT",
+	}
+	flagTLSCert = cli.StringFlag{
+		Name:   "tls-cert",
+		Usage:  "TLS certificate for the tcp listener",
+		EnvVar: "MACVLAN_TLS_CERT",
+	}
+	flagTLSKey = cli.StringFlag{
+		Name:   "tls-key",
+		Usage:  "TLS key for the tcp listener",
+		EnvVar: "MACVLAN_TLS_KEY",
+	}
+	flagTLSCACert = cli.StringFlag{
+		Name:   "tls-cacert",
+		Usage:  "CA used to verify dockerd client certificates and written to the plugin spec for dockerd to verify the plugin",
+		EnvVar: "MACVLAN_TLS_CACERT",
+	}
+	flagTLSServerCA = cli.StringFlag{
+		Name:   "tls-server-ca",
+		Usage:  "CA written to the plugin spec for dockerd to verify the plugin certificate, defaults to --tls-cacert",
+		EnvVar: "MACVLAN_TLS_SERVER_CA",
+	}
+	flagAdvertiseAddr = cli.StringFlag{
+		Name:   "advertise-addr",
+		Usage:  "host:port written to the plugin spec for dockerd to dial, defaults to the tcp listen address",
+		EnvVar: "MACVLAN_ADVERTISE_ADDR",
+	}
+	flagTLSClientCert = cli.StringFlag{
+		Name:   "tls-client-cert",
+		Usage:  "client certificate written to the plugin spec for dockerd to present",
+		EnvVar: "MACVLAN_TLS_CLIENT_CERT",
 	}
+	flagTLSClientKey = cli.StringFlag{
+		Name:   "tls-client-key",
+		Usage:  "client key written to the plugin spec for dockerd to present",
+		EnvVar: "MACVLAN_TLS_CLIENT_KEY",
+	}
+	flagScope = cli.StringFlag{
+		Name:   "scope",
+		Value:  "local",
+		Usage:  "driver scope [local|global], global coordinates networks, addresses and macs between hosts through --store",
+		EnvVar: "MACVLAN_SCOPE",
+	}
+	flagStore = cli.StringFlag{
+		Name:   "store",
+		Usage:  "store used in global scope [file:///path/to/store.json|etcd://host:port,host:port]",
+		EnvVar: "MACVLAN_STORE",
+	}
+	appFlags = []cli.Flag{
+		flagDebug,
+		flagLogFormat,
+		flagLogFile,
+		flagLogMaxSize,
+		flagLogMaxFiles,
+		flagAuditLog,
+		flagListen,
+		flagAdminSocket,
+		flagDockerHost,
+		flagShutdownTimeout,
+		flagTLSCert,
+		flagTLSKey,
+		flagTLSCACert,
+		flagTLSServerCA,
+		flagTLSClientCert,
+		flagTLSClientKey,
+		flagAdvertiseAddr,
+		flagScope,
+		flagStore,
+	}
+)
+
+func main() {
 	app := cli.NewApp()
 	app.Name = "macvlan"
 	app.Usage = "Docker Macvlan Networking"
 	app.Version = version
-	app.Flags = []cli.Flag{
-		flagDebug,
+	app.Flags = appFlags
+	app.Commands = []cli.Command{
+		pluginConfigCommand,
+		loadtestCommand,
+		auditCommand,
+		healthCommand,
 	}
 	app.Action = Run
 	app.Run(os.Args)
@@ -32,14 +163,56 @@ func main() {
 
 // Run initializes the driver
 func Run(ctx *cli.Context) {
-	if ctx.Bool("debug") {
-		log.SetLevel(log.DebugLevel)
+	if err := setupLogging(ctx); err != nil {
+		log.Fatalf("unable to set up logging: %s", err)
 	}
 
 	d, err := macvlan.NewDriver(version, ctx)
 	if err != nil {
 		panic(err)
 	}
-	h := network.NewHandler(d)
-	h.ServeUnix("root", "macvlan")
+	l, err := newListener(ctx)
+	if err != nil {
+		log.Fatalf("unable to start the plugin listener: %s", err)
+	}
+	srv := newPluginServer(network.NewHandler(d))
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(l)
+	}()
+	var admin *listener
+	if path := ctx.String("admin-socket"); path != "" {
+		if admin, err = newAdminListener(path); err != nil {
+			log.Fatalf("unable to start the admin listener: %s", err)
+		}
+		go serveAdmin(admin, d)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	exitCode := 0
+	select {
+	case sig := <-sigs:
+		log.Infof("Received [ %s ], shutting down the macvlan driver", sig)
+	case err := <-served:
+		log.Errorf("plugin listener exited: %s", err)
+		exitCode = 1
+	}
+	// Stop accepting new requests and remove the socket and spec files
+	l.Close()
+	if admin != nil {
+		admin.Close()
+	}
+	timeout := ctx.Duration("shutdown-timeout")
+	deadline := time.Now().Add(timeout)
+	if err := d.Shutdown(timeout); err != nil {
+		log.Errorf("unclean shutdown: %s", err)
+		exitCode = 1
+	}
+	// driver calls complete before their responses are written
+	if !srv.drain(deadline.Sub(time.Now())) {
+		log.Errorf("unclean shutdown: timed out after %s waiting for the plugin responses to be written", timeout)
+		exitCode = 1
+	}
+	os.Exit(exitCode)
 }
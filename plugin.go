@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/gopher-net/macvlan-docker-plugin/macvlan"
+)
+
+const (
+	dockerNetnsDir      = "/var/run/docker/netns"
+	pluginEntrypoint    = "/go/bin/macvlan-docker-plugin"
+	pluginDriverType    = "docker.networkdriver/1.0"
+	pluginDocumentation = "https://github.com/gopher-net/macvlan-docker-plugin"
+)
+
+// pluginConfigCommand prints the config.json for 'docker plugin create'
+var pluginConfigCommand = cli.Command{
+	Name:  "plugin-config",
+	Usage: "print the config.json used to package the driver as a docker managed plugin",
+	Action: func(ctx *cli.Context) {
+		b, err := json.MarshalIndent(newPluginConfig(appFlags), "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to generate the plugin config: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(b))
+	},
+}
+
+// pluginConfig is the subset of the docker managed plugin config.json used by the driver
+type pluginConfig struct {
+	Description   string          `json:"description"`
+	Documentation string          `json:"documentation"`
+	Entrypoint    []string        `json:"entrypoint"`
+	Interface     pluginInterface `json:"interface"`
+	Network       pluginNetwork   `json:"network"`
+	Linux         pluginLinux     `json:"linux"`
+	Mounts        []pluginMount   `json:"mounts"`
+	Env           []pluginSetting `json:"env"`
+	Args          pluginArgs      `json:"args"`
+}
+
+type pluginInterface struct {
+	Types  []string `json:"types"`
+	Socket string   `json:"socket"`
+}
+
+type pluginNetwork struct {
+	Type string `json:"type"`
+}
+
+type pluginLinux struct {
+	Capabilities []string `json:"capabilities"`
+}
+
+type pluginMount struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options"`
+	Settable    []string `json:"settable"`
+}
+
+type pluginSetting struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Settable    []string `json:"settable"`
+	Value       string   `json:"value"`
+}
+
+type pluginArgs struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Settable    []string `json:"settable"`
+	Value       []string `json:"value"`
+}
+
+// newPluginConfig builds the managed plugin config. Every flag bound to an
+// env var becomes a settable plugin env so the two can't drift apart.
+func newPluginConfig(flags []cli.Flag) *pluginConfig {
+	dockerSock := strings.TrimPrefix(macvlan.DefaultDockerHost, "unix://")
+	return &pluginConfig{
+		Description:   "Docker Macvlan Networking",
+		Documentation: pluginDocumentation,
+		Entrypoint:    []string{pluginEntrypoint},
+		Interface: pluginInterface{
+			Types:  []string{pluginDriverType},
+			Socket: pluginName + ".sock",
+		},
+		// macvlan links are created on the host netns and moved by libnetwork
+		Network: pluginNetwork{Type: "host"},
+		Linux: pluginLinux{
+			// CAP_SYS_ADMIN is needed to enter container netns to configure endpoints after they are moved
+			Capabilities: []string{"CAP_NET_ADMIN", "CAP_SYS_ADMIN"},
+		},
+		Mounts: []pluginMount{
+			{
+				Name:        "docker-socket",
+				Description: "docker API socket used to look up existing networks",
+				Source:      dockerSock,
+				Destination: dockerSock,
+				Type:        "bind",
+				Options:     []string{"rbind"},
+				Settable:    []string{"source"},
+			},
+			{
+				Name:        "docker-netns",
+				Description: "container sandbox netns bind mounts",
+				Source:      dockerNetnsDir,
+				Destination: dockerNetnsDir,
+				Type:        "bind",
+				Options:     []string{"rbind", "rslave"},
+			},
+		},
+		Env: pluginEnv(flags),
+		Args: pluginArgs{
+			Name:        "args",
+			Description: "additional command line arguments passed to the driver",
+			Settable:    []string{"value"},
+			Value:       []string{},
+		},
+	}
+}
+
+func pluginEnv(flags []cli.Flag) []pluginSetting {
+	var env []pluginSetting
+	for _, f := range flags {
+		var name, usage, value string
+		switch flag := f.(type) {
+		case cli.StringFlag:
+			name, usage, value = flag.EnvVar, flag.Usage, flag.Value
+		case cli.BoolFlag:
+			name, usage, value = flag.EnvVar, flag.Usage, "false"
+		case cli.IntFlag:
+			name, usage, value = flag.EnvVar, flag.Usage, strconv.Itoa(flag.Value)
+		case cli.DurationFlag:
+			name, usage, value = flag.EnvVar, flag.Usage, flag.Value.String()
+		}
+		if name == "" {
+			continue
+		}
+		env = append(env, pluginSetting{
+			Name:        name,
+			Description: usage,
+			Settable:    []string{"value"},
+			Value:       value,
+		})
+	}
+	return env
+}
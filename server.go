@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+)
+
+var errPipeClosed = errors.New("the plugin pipe listener is closed")
+
+// pluginServer serves the plugin API and counts the requests in flight so
+// the plugin only exits once their responses are written. A driver call
+// completes before go-plugins-helpers writes its response, and the helpers
+// handler can only be served on a listener, so requests are forwarded to it
+// over an in-memory pipe listener.
+type pluginServer struct {
+	proxy *httputil.ReverseProxy
+	pipe  *pipeListener
+	sync.Mutex
+	inflight int
+	draining bool
+	drained  chan struct{}
+}
+
+func newPluginServer(h *network.Handler) *pluginServer {
+	pipe := newPipeListener()
+	go h.Serve(pipe)
+	return &pluginServer{
+		proxy: &httputil.ReverseProxy{
+			Director: func(r *http.Request) {
+				r.URL.Scheme = "http"
+				r.URL.Host = pluginName
+			},
+			Transport: &http.Transport{
+				Dial: func(_, _ string) (net.Conn, error) {
+					return pipe.dial()
+				},
+			},
+		},
+		pipe:    pipe,
+		drained: make(chan struct{}),
+	}
+}
+
+// Serve the plugin API on l until it is closed
+func (s *pluginServer) Serve(l net.Listener) error {
+	server := &http.Server{Handler: s}
+	return server.Serve(l)
+}
+
+func (s *pluginServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.start() {
+		http.Error(w, "the macvlan plugin is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.done()
+	s.proxy.ServeHTTP(w, r)
+	// the response has to reach the socket before the request stops counting
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *pluginServer) start() bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.draining {
+		return false
+	}
+	s.inflight++
+	return true
+}
+
+func (s *pluginServer) done() {
+	s.Lock()
+	defer s.Unlock()
+	s.inflight--
+	if s.draining && s.inflight == 0 {
+		close(s.drained)
+	}
+}
+
+// drain refuses new requests and waits up to timeout for the responses in flight
+func (s *pluginServer) drain(timeout time.Duration) bool {
+	s.Lock()
+	s.draining = true
+	idle := s.inflight == 0
+	s.Unlock()
+	defer s.pipe.Close()
+	if idle {
+		return true
+	}
+	select {
+	case <-s.drained:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// pipeListener is an in-memory listener, every dial is accepted as one end of a net.Pipe
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, errPipeClosed
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errPipeClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }